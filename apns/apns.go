@@ -3,10 +3,13 @@ package apns
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mritd/logger"
@@ -24,13 +27,38 @@ type PushMessage struct {
 	Title       string `form:"title,omitempty" json:"title,omitempty" xml:"title,omitempty" query:"title,omitempty"`
 	Body        string `form:"body,omitempty" json:"body,omitempty" xml:"body,omitempty" query:"body,omitempty"`
 	// ios notification sound(system sound please refer to http://iphonedevwiki.net/index.php/AudioServices)
-	Sound     string                 `form:"sound,omitempty" json:"sound,omitempty" xml:"sound,omitempty" query:"sound,omitempty"`
-	ExtParams map[string]interface{} `form:"ext_params,omitempty" json:"ext_params,omitempty" xml:"ext_params,omitempty" query:"ext_params,omitempty"`
+	Sound string `form:"sound,omitempty" json:"sound,omitempty" xml:"sound,omitempty" query:"sound,omitempty"`
+	// Sound dictionary of the aps payload set by ParseSound, overrides Sound
+	SoundDict map[string]interface{} `form:"-" json:"-" xml:"-" query:"-"`
+	// Native app icon badge, nil leaves the badge unchanged
+	Badge *int `form:"-" json:"-" xml:"-" query:"-"`
+	// Localized alert fields set by SetLocField
+	TitleLocKey     string   `form:"-" json:"-" xml:"-" query:"-"`
+	TitleLocArgs    []string `form:"-" json:"-" xml:"-" query:"-"`
+	SubtitleLocKey  string   `form:"-" json:"-" xml:"-" query:"-"`
+	SubtitleLocArgs []string `form:"-" json:"-" xml:"-" query:"-"`
+	LocKey          string   `form:"-" json:"-" xml:"-" query:"-"`
+	LocArgs         []string `form:"-" json:"-" xml:"-" query:"-"`
+	// Native aps fields set by SetApsField
+	InterruptionLevel payload.EInterruptionLevel `form:"-" json:"-" xml:"-" query:"-"`
+	RelevanceScore    *float64                   `form:"-" json:"-" xml:"-" query:"-"`
+	TargetContentID   string                     `form:"-" json:"-" xml:"-" query:"-"`
+	FilterCriteria    string                     `form:"-" json:"-" xml:"-" query:"-"`
+	// APNs environment of the device, empty means production
+	Environment string `form:"-" json:"-" xml:"-" query:"-"`
+	// APNs credential profile of the device, empty means the default profile
+	Profile string `form:"-" json:"-" xml:"-" query:"-"`
+	// APNs request headers set by SetHeader, zero values use the defaults
+	Priority   int                    `form:"-" json:"-" xml:"-" query:"-"`
+	Expiration time.Time              `form:"-" json:"-" xml:"-" query:"-"`
+	CollapseID string                 `form:"-" json:"-" xml:"-" query:"-"`
+	PushType   apns2.EPushType        `form:"-" json:"-" xml:"-" query:"-"`
+	ExtParams  map[string]interface{} `form:"ext_params,omitempty" json:"ext_params,omitempty" xml:"ext_params,omitempty" query:"ext_params,omitempty"`
 }
 
 // Check if it's an empty message, empty messages might be silent push notifications
 func (p PushMessage) IsEmptyAlert() bool {
-	return p.Title == "" && p.Body == "" && p.Subtitle == ""
+	return p.Title == "" && p.Body == "" && p.Subtitle == "" && !p.isLocalized()
 }
 
 func (p PushMessage) IsDelete() bool {
@@ -38,37 +66,102 @@ func (p PushMessage) IsDelete() bool {
 	return val == "1" || val == 1 || val == 1.0
 }
 
+// Validate checks the parameters of the message are consistent with each other
+func (p *PushMessage) Validate() error {
+	if p.PushType == apns2.PushTypeBackground && p.Priority == apns2.PriorityHigh {
+		return fmt.Errorf("background notifications must use priority %d", apns2.PriorityLow)
+	}
+	switch {
+	case len(p.TitleLocArgs) > 0 && p.TitleLocKey == "":
+		return fmt.Errorf("title_loc_args requires title_loc_key")
+	case len(p.SubtitleLocArgs) > 0 && p.SubtitleLocKey == "":
+		return fmt.Errorf("subtitle_loc_args requires subtitle_loc_key")
+	case len(p.LocArgs) > 0 && p.LocKey == "":
+		return fmt.Errorf("loc_args requires loc_key")
+	}
+	return nil
+}
+
+// PayloadMaximum is the size limit of the APNs payloads in bytes
+const PayloadMaximum = 4096
+
+// APNs environments a device can be registered with
 const (
-	topic          = "me.fin.bark"
-	keyID          = "LH4T9V5U4R"
-	teamID         = "5U8LBRXG3A"
-	PayloadMaximum = 4096
+	EnvironmentProduction  = "production"
+	EnvironmentDevelopment = "development"
 )
 
-var clients = make(chan *apns2.Client, 1)
+// apnsHosts maps the environments to the APNs gateways
+var apnsHosts = map[string]string{
+	EnvironmentProduction:  apns2.HostProduction,
+	EnvironmentDevelopment: apns2.HostDevelopment,
+}
 
-// Initialize APNS client pool
-func init() {
-	ReCreateAPNS(1)
+// ParseEnvironment normalizes the environment of a device registration,
+// "sandbox" is accepted as an alias of development and empty means production
+func ParseEnvironment(env string) (string, error) {
+	switch strings.ToLower(env) {
+	case "", EnvironmentProduction:
+		return EnvironmentProduction, nil
+	case EnvironmentDevelopment, "sandbox":
+		return EnvironmentDevelopment, nil
+	default:
+		return "", fmt.Errorf("invalid environment: %s", env)
+	}
 }
 
-func ReCreateAPNS(maxClientCount int) error {
-	if maxClientCount < 1 {
-		return fmt.Errorf("invalid number of clients")
+// profileClients holds the client pools of a profile
+type profileClients struct {
+	topic string
+	// client pools by environment
+	pools map[string]*clientPool
+	// push settings of the configuration the clients were created with,
+	// so a push never mixes the settings of two reloads
+	retryPolicy RetryPolicy
+	payloadMode string
+}
+
+var (
+	// client pools by profile name, replaced as a whole when the configuration is reloaded
+	clients     = map[string]*profileClients{}
+	clientsLock sync.RWMutex
+)
+
+// lookupProfile returns the client pools of a profile, empty means the default profile
+func lookupProfile(name string) (*profileClients, error) {
+	if name == "" {
+		name = DefaultProfile
 	}
 
-	authKey, err := token.AuthKeyFromBytes([]byte(apnsPrivateKey))
-	if err != nil {
-		logger.Fatalf("failed to create APNS auth key: %v", err)
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+	pc, ok := clients[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown apns profile: %s", name)
+	}
+	return pc, nil
+}
+
+// Initialize APNS client pool
+func init() {
+	if err := ReCreateAPNS(DefaultConfig()); err != nil {
+		logger.Fatalf("failed to init apns client: %v", err)
 	}
+}
 
+func ReCreateAPNS(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	var err error
 	var rootCAs *x509.CertPool
 	if runtime.GOOS == "windows" {
 		rootCAs = x509.NewCertPool()
 	} else {
 		rootCAs, err = x509.SystemCertPool()
 		if err != nil {
-			logger.Fatalf("failed to get rootCAs: %v", err)
+			return fmt.Errorf("failed to get rootCAs: %v", err)
 		}
 	}
 
@@ -76,75 +169,267 @@ func ReCreateAPNS(maxClientCount int) error {
 		rootCAs.AppendCertsFromPEM([]byte(ca))
 	}
 
-	clients = make(chan *apns2.Client, maxClientCount)
+	var dialer *proxyDialer
+	if cfg.Proxy != "" {
+		if dialer, err = newProxyDialer(cfg.Proxy); err != nil {
+			return err
+		}
+	}
 
-	for i := 0; i < min(runtime.NumCPU(), maxClientCount); i++ {
-		client := &apns2.Client{
-			Token: &token.Token{
-				AuthKey: authKey,
-				KeyID:   keyID,
-				TeamID:  teamID,
-			},
-			HTTPClient: &http.Client{
-				Transport: &http2.Transport{
-					DialTLS: apns2.DialTLS,
-					TLSClientConfig: &tls.Config{
-						RootCAs: rootCAs,
-					},
-				},
-				Timeout: apns2.HTTPClientTimeout,
-			},
-			Host: apns2.HostProduction,
+	newClients := make(map[string]*profileClients, len(cfg.Profiles))
+	for i := range cfg.Profiles {
+		profile := &cfg.Profiles[i]
+		pc, err := newProfileClients(profile, rootCAs, cfg.MaxClientCount, cfg.Host, dialer)
+		if err != nil {
+			return err
+		}
+		pc.retryPolicy, pc.payloadMode = cfg.RetryPolicy, cfg.PayloadMode
+		newClients[profile.Name] = pc
+		if profile.AuthType == AuthTypeCertificate {
+			logger.Infof("init apns profile [%s] success, topic: %s, certificate: %s",
+				profile.Name, profile.Topic, profile.CertFile)
+		} else {
+			logger.Infof("init apns profile [%s] success, topic: %s, key id: %s, team id: %s",
+				profile.Name, profile.Topic, profile.KeyID, profile.TeamID)
 		}
-		logger.Infof("create apns client: %d", i)
-		clients <- client
 	}
 
+	clientsLock.Lock()
+	oldClients := clients
+	clients = newClients
+	clientsLock.Unlock()
+
+	// In-flight pushes of the replaced clients complete within the HTTP client timeout
+	time.AfterFunc(apns2.HTTPClientTimeout, func() {
+		for _, pc := range oldClients {
+			for _, pool := range pc.pools {
+				pool.close()
+			}
+		}
+	})
+
+	if dialer != nil {
+		logger.Infof("apns connections use proxy: %s", dialer.proxy.Redacted())
+	}
+	if cfg.Host != "" {
+		logger.Infof("init apns client success, host: %s", cfg.Host)
+		return nil
+	}
 	logger.Info("init apns client success...")
 	return nil
 }
 
-func Push(msg *PushMessage) (code int, err error) {
+// newProfileClients creates the client pools of every environment for a profile,
+// the connections are dialed through the proxy dialer unless it is nil
+func newProfileClients(profile *Profile, rootCAs *x509.CertPool, maxClientCount int, hostOverride string, dialer *proxyDialer) (*profileClients, error) {
+	var authToken *token.Token
+	var cert tls.Certificate
+	if profile.AuthType == AuthTypeCertificate {
+		var err error
+		if cert, err = profile.loadCertificate(); err != nil {
+			return nil, err
+		}
+	} else {
+		keyBytes, err := profile.loadAuthKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read APNS auth key of profile [%s]: %v", profile.Name, err)
+		}
+		authKey, err := token.AuthKeyFromBytes(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create APNS auth key of profile [%s]: %v", profile.Name, err)
+		}
+		authToken = &token.Token{
+			AuthKey: authKey,
+			KeyID:   profile.KeyID,
+			TeamID:  profile.TeamID,
+		}
+	}
+
+	pc := &profileClients{
+		topic: profile.Topic,
+		pools: make(map[string]*clientPool, len(apnsHosts)),
+	}
+	for env, host := range apnsHosts {
+		if hostOverride != "" {
+			host = hostOverride
+		}
+		newClient := func() *apns2.Client {
+			tlsConfig := &tls.Config{
+				RootCAs: rootCAs,
+			}
+			if authToken == nil {
+				tlsConfig.Certificates = []tls.Certificate{cert}
+			}
+			transport := &http2.Transport{
+				DialTLS:         apns2.DialTLS,
+				TLSClientConfig: tlsConfig,
+			}
+			if dialer != nil {
+				transport.DialTLS = dialer.DialTLS
+			}
+			if strings.HasPrefix(host, "http://") {
+				transport.AllowHTTP = true
+				transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					if dialer != nil {
+						return dialer.Dial(network, addr)
+					}
+					return net.DialTimeout(network, addr, apns2.TLSDialTimeout)
+				}
+			}
+			return &apns2.Client{
+				Token:       authToken,
+				Certificate: cert,
+				HTTPClient:  newHTTPClient(transport),
+				Host:        host,
+			}
+		}
+		pc.pools[env] = newClientPool(profile.Name, env, maxClientCount, newClient)
+	}
+	return pc, nil
+}
+
+// PushResult describes the outcome of a push
+type PushResult struct {
+	// HTTP status code of the last attempt, 500 for connection errors
+	StatusCode int
+	// APNs error reason of the last attempt
+	Reason string
+	// Number of retries after transient failures
+	Retries int
+	// Last time APNs confirmed the device token was no longer valid, set with 410 only
+	Timestamp time.Time
+	// apns-id of the notification, apns-unique-id in the development environment only
+	ApnsID       string
+	ApnsUniqueID string
+}
+
+func Push(msg *PushMessage) (*PushResult, error) {
 	pl := payload.NewPayload().MutableContent()
 	pushType := apns2.PushTypeAlert
-	if msg.IsDelete() {
+	// The alert body, shortened if the payload is too large
+	body := ""
+	if msg.PushType != "" {
+		pushType = msg.PushType
+	}
+	if msg.IsDelete() || pushType == apns2.PushTypeBackground {
 		// Silent push notification
 		pl = pl.ContentAvailable()
 		pushType = apns2.PushTypeBackground
 	} else {
 		// Regular push notification
+		if msg.Badge != nil {
+			pl = pl.Badge(*msg.Badge)
+		}
 		pl = pl.AlertTitle(msg.Title).
 			AlertSubtitle(msg.Subtitle).
 			AlertBody(msg.Body).
-			Sound(msg.Sound).
 			Category("myNotificationCategory")
+		if msg.isLocalized() {
+			// Rendered by the device in its own language, the literal texts are the fallback
+			if msg.TitleLocKey != "" {
+				pl = pl.AlertTitleLocKey(msg.TitleLocKey).AlertTitleLocArgs(msg.TitleLocArgs)
+			}
+			if msg.SubtitleLocKey != "" {
+				pl = pl.AlertSubtitleLocKey(msg.SubtitleLocKey).AlertSubtitleLocArgs(msg.SubtitleLocArgs)
+			}
+			if msg.LocKey != "" {
+				pl = pl.AlertLocKey(msg.LocKey).AlertLocArgs(msg.LocArgs)
+			}
+		}
+		switch {
+		case msg.SoundDict != nil:
+			pl = pl.Sound(msg.SoundDict)
+		case msg.InterruptionLevel == payload.InterruptionLevelCritical:
+			pl = pl.Sound(msg.criticalSound())
+		default:
+			pl = pl.Sound(msg.Sound)
+		}
+		if msg.InterruptionLevel != "" {
+			pl = pl.InterruptionLevel(msg.InterruptionLevel)
+		}
+		if msg.RelevanceScore != nil {
+			pl = pl.RelevanceScore(float32(*msg.RelevanceScore))
+		}
+		body = msg.Body
 		group, exist := msg.ExtParams["group"]
 		if exist {
-			pl = pl.ThreadID(group.(string))
+			pl = pl.ThreadID(fmt.Sprintf("%v", group))
 		}
 	}
 
 	for k, v := range msg.ExtParams {
-		// Change all parameter names to lowercase to prevent inconsistent capitalization
-		pl.Custom(strings.ToLower(k), fmt.Sprintf("%v", v))
+		// Change all parameter names to lowercase to prevent inconsistent capitalization,
+		// the values keep their JSON types
+		pl.Custom(strings.ToLower(k), v)
+	}
+	np := &notificationPayload{Payload: pl, aps: make(map[string]interface{})}
+	if msg.TargetContentID != "" {
+		np.aps["target-content-id"] = msg.TargetContentID
+	}
+	if msg.FilterCriteria != "" {
+		np.aps["filter-criteria"] = msg.FilterCriteria
+	}
+	pc, err := lookupProfile(msg.Profile)
+	if err != nil {
+		return &PushResult{StatusCode: 400}, err
+	}
+	if err := fitPayload(np, body, pc.payloadMode); err != nil {
+		return &PushResult{StatusCode: http.StatusRequestEntityTooLarge}, err
 	}
 
-	client := <-clients // grab a client from the pool
-	clients <- client   // add the client back to the pool
+	priority := msg.Priority
+	if pushType == apns2.PushTypeBackground {
+		// Background notifications must be sent with low priority
+		if priority == 0 {
+			priority = apns2.PriorityLow
+		}
+	}
+	collapseID := msg.CollapseID
+	if collapseID == "" {
+		collapseID = msg.Id
+	}
+	expiration := msg.Expiration
+	if expiration.IsZero() {
+		expiration = time.Now().Add(defaultExpiration)
+	}
 
-	resp, err := client.Push(&apns2.Notification{
-		CollapseID:  msg.Id,
+	env, err := ParseEnvironment(msg.Environment)
+	if err != nil {
+		return &PushResult{StatusCode: 400}, err
+	}
+
+	return send(pc.pools[env], pc.retryPolicy, &apns2.Notification{
+		CollapseID:  collapseID,
 		DeviceToken: msg.DeviceToken,
-		Topic:       topic,
-		Payload:     pl,
-		Expiration:  time.Now().Add(24 * time.Hour),
+		Topic:       pc.topic,
+		Payload:     np,
+		Priority:    priority,
+		Expiration:  expiration,
 		PushType:    pushType,
 	})
-	if err != nil {
-		return 500, err
-	}
-	if resp.StatusCode != 200 {
-		return resp.StatusCode, fmt.Errorf(resp.Reason)
+}
+
+// send pushes the notification, transient failures are retried following the retry policy
+func send(pool *clientPool, policy RetryPolicy, notification *apns2.Notification) (*PushResult, error) {
+	result := &PushResult{}
+	for attempt := 1; ; attempt++ {
+		resp, err := pool.push(notification)
+		if err != nil {
+			result.StatusCode, result.Reason = 500, ""
+		} else {
+			result.StatusCode, result.Reason = resp.StatusCode, resp.Reason
+			result.Timestamp = resp.Timestamp.Time
+			result.ApnsID, result.ApnsUniqueID = resp.ApnsID, resp.ApnsUniqueID
+			if resp.Sent() {
+				return result, nil
+			}
+			err = errors.New(resp.Reason)
+		}
+
+		if attempt >= policy.MaxAttempts || !retryable(resp) {
+			return result, err
+		}
+		result.Retries++
+		time.Sleep(policy.delay(attempt))
 	}
-	return 200, nil
 }
@@ -0,0 +1,466 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/finb/bark-server/v2/apns/fakeapns"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sideshow/apns2/token"
+)
+
+const testDeviceToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// writeAuthKey writes a new .p8 auth key to the test directory
+func writeAuthKey(t *testing.T) (string, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "AuthKey.p8")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// useGateways points every APNs environment to its own fake gateway until the test ends
+func useGateways(t *testing.T) map[string]*fakeapns.Server {
+	gateways := make(map[string]*fakeapns.Server, len(apnsHosts))
+	hosts := make(map[string]string, len(apnsHosts))
+	for env := range apnsHosts {
+		gateway := fakeapns.New()
+		srv := httptest.NewServer(gateway.Handler())
+		t.Cleanup(srv.Close)
+		gateways[env] = gateway
+		hosts[env] = srv.URL
+	}
+
+	oldHosts := apnsHosts
+	apnsHosts = hosts
+	t.Cleanup(func() {
+		apnsHosts = oldHosts
+		if err := ReCreateAPNS(DefaultConfig()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return gateways
+}
+
+// onlyNotification returns the notification received by the gateway, failing unless there's exactly one
+func onlyNotification(t *testing.T, gateway *fakeapns.Server) fakeapns.Notification {
+	t.Helper()
+	notifications := gateway.Notifications()
+	if len(notifications) != 1 {
+		t.Fatalf("want 1 notification, got %d", len(notifications))
+	}
+	return notifications[0]
+}
+
+// providerToken verifies the bearer token of a notification with the auth key and returns its key id and issuer
+func providerToken(t *testing.T, n fakeapns.Notification, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+	if !strings.HasPrefix(n.Authorization, "bearer ") {
+		t.Fatalf("want token authentication, got authorization %q", n.Authorization)
+	}
+	claims := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(strings.TrimPrefix(n.Authorization, "bearer "), &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			t.Fatalf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return &key.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("invalid provider token: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid, claims.Issuer
+}
+
+func TestConfigValidate(t *testing.T) {
+	keyFile, _ := writeAuthKey(t)
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{
+			name: "Embedded Bark key",
+			cfg:  Config{Profiles: []Profile{{Name: DefaultProfile}}, MaxClientCount: 1},
+		},
+		{
+			name: "Embedded Bark key with its own ids",
+			cfg:  Config{Profiles: []Profile{{Name: DefaultProfile, KeyID: defaultKeyID, TeamID: defaultTeamID, Topic: defaultTopic}}, MaxClientCount: 1},
+		},
+		{
+			name: "Custom key",
+			cfg:  Config{Profiles: []Profile{{Name: DefaultProfile, KeyFile: keyFile, KeyID: "ABC123DEFG", TeamID: "TEAM123456", Topic: "com.example.app"}}, MaxClientCount: 1},
+		},
+		{
+			name:    "No clients",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile}}},
+			wantErr: "invalid number of clients",
+		},
+		{
+			name:    "No default profile",
+			cfg:     Config{Profiles: []Profile{{Name: "beta", KeyFile: keyFile, KeyID: "ABC123DEFG", TeamID: "TEAM123456", Topic: "com.example.beta"}}, MaxClientCount: 1},
+			wantErr: "apns profile [default] is required",
+		},
+		{
+			name:    "Duplicate profile",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile}, {Name: DefaultProfile}}, MaxClientCount: 1},
+			wantErr: "duplicate apns profile: default",
+		},
+		{
+			name:    "Custom topic without key file",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile, Topic: "com.example.app"}}, MaxClientCount: 1},
+			wantErr: "apns key file is required",
+		},
+		{
+			name:    "Custom key without key id",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile, KeyFile: keyFile, TeamID: "TEAM123456", Topic: "com.example.app"}}, MaxClientCount: 1},
+			wantErr: "apns key id of profile [default] is required",
+		},
+		{
+			name:    "Custom key without team id",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile, KeyFile: keyFile, KeyID: "ABC123DEFG", Topic: "com.example.app"}}, MaxClientCount: 1},
+			wantErr: "apns team id of profile [default] is required",
+		},
+		{
+			name:    "Custom key without topic",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile, KeyFile: keyFile, KeyID: "ABC123DEFG", TeamID: "TEAM123456"}}, MaxClientCount: 1},
+			wantErr: "apns topic of profile [default] is required",
+		},
+		{
+			name:    "Invalid retry policy",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile}}, MaxClientCount: 1, RetryPolicy: RetryPolicy{Backoff: time.Second}},
+			wantErr: "invalid number of apns push attempts: 0",
+		},
+		{
+			name:    "Invalid payload mode",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile}}, MaxClientCount: 1, PayloadMode: "drop"},
+			wantErr: "invalid apns payload mode: drop",
+		},
+		{
+			name:    "Invalid auth type",
+			cfg:     Config{Profiles: []Profile{{Name: DefaultProfile, AuthType: "password"}}, MaxClientCount: 1},
+			wantErr: "invalid apns auth type of profile [default]: password",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if p := tt.cfg.Profiles[0]; p.AuthType != AuthTypeToken || p.KeyID == "" || p.TeamID == "" || p.Topic == "" {
+					t.Fatalf("defaults not filled in: %+v", p)
+				}
+				if tt.cfg.RetryPolicy != DefaultRetryPolicy() || tt.cfg.PayloadMode != PayloadModeTruncate {
+					t.Fatalf("push defaults not filled in: %+v", tt.cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("want error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDefaultCredentials(t *testing.T) {
+	gateways := useGateways(t)
+	key, err := token.AuthKeyFromBytes([]byte(apnsPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReCreateAPNS(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := onlyNotification(t, gateways[EnvironmentProduction])
+	if n.Topic != defaultTopic {
+		t.Fatalf("want topic %s, got %s", defaultTopic, n.Topic)
+	}
+	if kid, iss := providerToken(t, n, key); kid != defaultKeyID || iss != defaultTeamID {
+		t.Fatalf("want the token of the Bark key, got %s of %s", kid, iss)
+	}
+}
+
+func TestCustomCredentials(t *testing.T) {
+	gateways := useGateways(t)
+	keyFile, key := writeAuthKey(t)
+
+	err := ReCreateAPNS(Config{
+		Profiles:       []Profile{{Name: DefaultProfile, KeyFile: keyFile, KeyID: "ABC123DEFG", TeamID: "TEAM123456", Topic: "com.example.app"}},
+		MaxClientCount: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := onlyNotification(t, gateways[EnvironmentProduction])
+	if n.Topic != "com.example.app" || n.DeviceToken != testDeviceToken {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	if kid, iss := providerToken(t, n, key); kid != "ABC123DEFG" || iss != "TEAM123456" {
+		t.Fatalf("want the token of key ABC123DEFG of team TEAM123456, got %s of %s", kid, iss)
+	}
+
+	// A missing key file fails before the running clients are replaced
+	err = ReCreateAPNS(Config{
+		Profiles:       []Profile{{Name: DefaultProfile, KeyFile: filepath.Join(t.TempDir(), "missing.p8"), KeyID: "ABC123DEFG", TeamID: "TEAM123456", Topic: "com.example.app"}},
+		MaxClientCount: 1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to read APNS auth key of profile [default]") {
+		t.Fatalf("want auth key error, got %v", err)
+	}
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body"}); err != nil {
+		t.Fatalf("the previous clients were replaced: %v", err)
+	}
+}
+
+func TestEnvironmentRouting(t *testing.T) {
+	gateways := useGateways(t)
+	if err := ReCreateAPNS(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		env  string
+		want string
+	}{
+		{env: "", want: EnvironmentProduction},
+		{env: "production", want: EnvironmentProduction},
+		{env: "development", want: EnvironmentDevelopment},
+		{env: "Sandbox", want: EnvironmentDevelopment},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			for _, gateway := range gateways {
+				gateway.Reset()
+			}
+			if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body", Environment: tt.env}); err != nil {
+				t.Fatal(err)
+			}
+			for env, gateway := range gateways {
+				if n := len(gateway.Notifications()); (env == tt.want) != (n == 1) {
+					t.Fatalf("want the notification on the %s gateway, the %s gateway got %d", tt.want, env, n)
+				}
+			}
+			if n := onlyNotification(t, gateways[tt.want]); n.Topic != defaultTopic {
+				t.Fatalf("want topic %s, got %s", defaultTopic, n.Topic)
+			}
+		})
+	}
+
+	result, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body", Environment: "staging"})
+	if err == nil || result.StatusCode != 400 {
+		t.Fatalf("want 400 for an invalid environment, got %d: %v", result.StatusCode, err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	gateways := useGateways(t)
+	betaKeyFile, betaKey := writeAuthKey(t)
+
+	profilesFile := filepath.Join(t.TempDir(), "profiles.json")
+	profilesJSON := `[{"name": "beta", "key_file": "` + betaKeyFile + `", "key_id": "BETA123456", "team_id": "TEAM123456", "topic": "com.example.beta"}]`
+	if err := os.WriteFile(profilesFile, []byte(profilesJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := LoadProfiles(profilesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Profiles = append(cfg.Profiles, profiles...)
+	if err := ReCreateAPNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		profile string
+		want    string
+	}{
+		{profile: "", want: DefaultProfile},
+		{profile: "beta", want: "beta"},
+		{profile: "alpha", want: ""},
+	} {
+		got, err := ParseProfile(tt.profile)
+		if got != tt.want || (tt.want == "") != (err != nil) {
+			t.Fatalf("ParseProfile(%q) = %q, %v, want %q", tt.profile, got, err, tt.want)
+		}
+	}
+
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body", Profile: "beta", Environment: EnvironmentDevelopment}); err != nil {
+		t.Fatal(err)
+	}
+	n := onlyNotification(t, gateways[EnvironmentDevelopment])
+	if n.Topic != "com.example.beta" {
+		t.Fatalf("want topic com.example.beta, got %s", n.Topic)
+	}
+	if kid, iss := providerToken(t, n, betaKey); kid != "BETA123456" || iss != "TEAM123456" {
+		t.Fatalf("want the token of key BETA123456 of team TEAM123456, got %s of %s", kid, iss)
+	}
+
+	// The devices without a profile keep using the default one
+	gateways[EnvironmentDevelopment].Reset()
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body", Environment: EnvironmentDevelopment}); err != nil {
+		t.Fatal(err)
+	}
+	if n := onlyNotification(t, gateways[EnvironmentDevelopment]); n.Topic != defaultTopic {
+		t.Fatalf("want topic %s, got %s", defaultTopic, n.Topic)
+	}
+
+	result, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body", Profile: "alpha"})
+	if err == nil || result.StatusCode != 400 {
+		t.Fatalf("want 400 for an unknown profile, got %d: %v", result.StatusCode, err)
+	}
+}
+
+// writeCertificate writes a push certificate combined with its key to a .pem file,
+// the bundle ID is put in the subject UID like in the certificates issued by Apple
+func writeCertificate(t *testing.T, bundleID string, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "Apple Push Services: " + bundleID}
+	if bundleID != "" {
+		subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: bundleID}}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	pemBytes = append(pemBytes, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	path := filepath.Join(t.TempDir(), "push.pem")
+	if err := os.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useTLSGateway installs the clients of the profile connecting to a fake gateway over TLS
+// which requires a client certificate, so the certificate authentication is exercised
+func useTLSGateway(t *testing.T, profile Profile) *fakeapns.Server {
+	gateway := fakeapns.New()
+	srv := httptest.NewUnstartedServer(gateway)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	if err := profile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+	pc, err := newProfileClients(&profile, rootCAs, 1, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientsLock.Lock()
+	oldClients := clients
+	clients = map[string]*profileClients{DefaultProfile: pc}
+	clientsLock.Unlock()
+	t.Cleanup(func() {
+		clientsLock.Lock()
+		clients = oldClients
+		clientsLock.Unlock()
+	})
+	return gateway
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	certFile := writeCertificate(t, "com.example.cert", time.Now().Add(365*24*time.Hour))
+	gateway := useTLSGateway(t, Profile{Name: DefaultProfile, AuthType: AuthTypeCertificate, CertFile: certFile})
+
+	if _, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body"}); err != nil {
+		t.Fatal(err)
+	}
+	n := onlyNotification(t, gateway)
+	// The topic is read from the UID of the certificate
+	if n.Topic != "com.example.cert" {
+		t.Fatalf("want topic com.example.cert, got %s", n.Topic)
+	}
+	if n.Authorization != "" {
+		t.Fatalf("want certificate authentication, got authorization %q", n.Authorization)
+	}
+	if n.ClientCertificate != "Apple Push Services: com.example.cert" {
+		t.Fatalf("want the push certificate, got %q", n.ClientCertificate)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	// An explicit topic is used as is
+	p := Profile{Name: "cert", AuthType: AuthTypeCertificate, CertFile: writeCertificate(t, "com.example.cert", time.Now().Add(time.Hour)), Topic: "com.example.other"}
+	if _, err := p.loadCertificate(); err != nil || p.Topic != "com.example.other" {
+		t.Fatalf("want topic com.example.other, got %s: %v", p.Topic, err)
+	}
+
+	// Without UID the topic must be configured
+	p = Profile{Name: "cert", AuthType: AuthTypeCertificate, CertFile: writeCertificate(t, "", time.Now().Add(time.Hour))}
+	if _, err := p.loadCertificate(); err == nil || !strings.Contains(err.Error(), "apns topic of profile [cert] is required") {
+		t.Fatalf("want topic error, got %v", err)
+	}
+
+	p = Profile{Name: "cert", AuthType: AuthTypeCertificate, CertFile: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := p.loadCertificate(); err == nil || !strings.Contains(err.Error(), "failed to load APNS certificate of profile [cert]") {
+		t.Fatalf("want certificate error, got %v", err)
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		notAfter time.Time
+		want     string
+	}{
+		{notAfter: now.Add(90 * 24 * time.Hour), want: ""},
+		{notAfter: now.Add(10*24*time.Hour + time.Hour), want: "APNS certificate of profile [cert] expires in 10 days at 2024-06-11T01:00:00Z"},
+		{notAfter: now.Add(-time.Hour), want: "APNS certificate of profile [cert] expired at 2024-05-31T23:00:00Z"},
+	} {
+		if got := expiryWarning("cert", tt.notAfter, now); got != tt.want {
+			t.Fatalf("want %q, got %q", tt.want, got)
+		}
+	}
+}
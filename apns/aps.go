@@ -0,0 +1,184 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sideshow/apns2/payload"
+)
+
+// Critical alerts are played at half volume unless the volume (0-10) is given
+const defaultCriticalVolume = 5
+
+// interruptionLevels maps the level parameter to the aps interruption levels
+var interruptionLevels = map[string]payload.EInterruptionLevel{
+	"passive":        payload.InterruptionLevelPassive,
+	"active":         payload.InterruptionLevelActive,
+	"timesensitive":  payload.InterruptionLevelTimeSensitive,
+	"time-sensitive": payload.InterruptionLevelTimeSensitive,
+	"critical":       payload.InterruptionLevelCritical,
+}
+
+// SetApsField sets a native aps field of the message: level, relevance_score,
+// target_content_id and filter_criteria, empty values are ignored
+func (p *PushMessage) SetApsField(key string, val interface{}) error {
+	value := strings.TrimSpace(fmt.Sprint(val))
+	if value == "" {
+		return nil
+	}
+	switch key {
+	case "level":
+		level, ok := interruptionLevels[strings.ToLower(value)]
+		if !ok {
+			return fmt.Errorf("invalid level: %s, must be critical, active, timeSensitive or passive", value)
+		}
+		p.InterruptionLevel = level
+	case "relevance_score":
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil || score < 0 || score > 1 {
+			return fmt.Errorf("invalid relevance_score: %s, must be between 0 and 1", value)
+		}
+		p.RelevanceScore = &score
+	case "target_content_id":
+		p.TargetContentID = value
+	case "filter_criteria":
+		p.FilterCriteria = value
+	default:
+		return fmt.Errorf("unknown aps field: %s", key)
+	}
+	return nil
+}
+
+// criticalSound returns the sound dictionary of a critical alert,
+// the volume parameter ranges from 0 to 10 like in the app
+func (p *PushMessage) criticalSound() map[string]interface{} {
+	volume := float64(defaultCriticalVolume)
+	if v, ok := p.ExtParams["volume"]; ok {
+		if f, err := strconv.ParseFloat(fmt.Sprint(v), 64); err == nil && f >= 0 && f <= 10 {
+			volume = f
+		}
+	}
+	return map[string]interface{}{
+		"critical": 1,
+		"name":     SoundFile(p.Sound),
+		"volume":   volume / 10,
+	}
+}
+
+// SoundFile returns the file name of a bundled sound, the sound parameter is its name
+func SoundFile(sound string) string {
+	// Compatible with old parameters
+	if strings.HasSuffix(sound, ".caf") {
+		return sound
+	}
+	return sound + ".caf"
+}
+
+// notificationPayload adds the aps fields apns2 has no builder for to the payload
+type notificationPayload struct {
+	*payload.Payload
+	aps map[string]interface{}
+}
+
+func (p *notificationPayload) MarshalJSON() ([]byte, error) {
+	b, err := p.Payload.MarshalJSON()
+	if err != nil || len(p.aps) == 0 {
+		return b, err
+	}
+	var content map[string]json.RawMessage
+	if err := json.Unmarshal(b, &content); err != nil {
+		return nil, err
+	}
+	aps := make(map[string]interface{})
+	if err := json.Unmarshal(content["aps"], &aps); err != nil {
+		return nil, err
+	}
+	for k, v := range p.aps {
+		aps[k] = v
+	}
+	if content["aps"], err = json.Marshal(aps); err != nil {
+		return nil, err
+	}
+	return json.Marshal(content)
+}
+
+// SetLocField sets a localized alert field of the message: title_loc_key, title_loc_args,
+// subtitle_loc_key, subtitle_loc_args, loc_key and loc_args. The arguments are given as
+// an array, a JSON array string or a comma separated string
+func (p *PushMessage) SetLocField(key string, val interface{}) error {
+	if strings.HasSuffix(key, "_loc_args") || key == "loc_args" {
+		args, err := parseLocArgs(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+		switch key {
+		case "title_loc_args":
+			p.TitleLocArgs = args
+		case "subtitle_loc_args":
+			p.SubtitleLocArgs = args
+		case "loc_args":
+			p.LocArgs = args
+		default:
+			return fmt.Errorf("unknown localization field: %s", key)
+		}
+		return nil
+	}
+
+	value, ok := val.(string)
+	if !ok {
+		return fmt.Errorf("invalid %s: %v", key, val)
+	}
+	switch key {
+	case "title_loc_key":
+		p.TitleLocKey = value
+	case "subtitle_loc_key":
+		p.SubtitleLocKey = value
+	case "loc_key":
+		p.LocKey = value
+	default:
+		return fmt.Errorf("unknown localization field: %s", key)
+	}
+	return nil
+}
+
+func parseLocArgs(val interface{}) ([]string, error) {
+	switch val := val.(type) {
+	case []interface{}:
+		args := make([]string, 0, len(val))
+		for _, arg := range val {
+			switch arg := arg.(type) {
+			case string:
+				args = append(args, arg)
+			case float64:
+				args = append(args, strconv.FormatFloat(arg, 'f', -1, 64))
+			case bool:
+				args = append(args, strconv.FormatBool(arg))
+			default:
+				return nil, fmt.Errorf("arguments must be strings or numbers")
+			}
+		}
+		return args, nil
+	case string:
+		var args []interface{}
+		if strings.HasPrefix(strings.TrimSpace(val), "[") && json.Unmarshal([]byte(val), &args) == nil {
+			return parseLocArgs(args)
+		}
+		if val == "" {
+			return nil, nil
+		}
+		parts := strings.Split(val, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return parts, nil
+	default:
+		return nil, fmt.Errorf("arguments must be an array")
+	}
+}
+
+// isLocalized reports whether the alert has any localized text
+func (p PushMessage) isLocalized() bool {
+	return p.TitleLocKey != "" || p.SubtitleLocKey != "" || p.LocKey != ""
+}
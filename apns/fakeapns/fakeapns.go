@@ -0,0 +1,210 @@
+// Package fakeapns implements a fake APNs HTTP/2 gateway, it records the received
+// notifications and can be scripted to reject them, so the push path can be tested offline.
+package fakeapns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finb/bark-server/v2/fakescript"
+	"github.com/lithammer/shortuuid/v3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const devicePathPrefix = "/3/device/"
+
+// AnyDevice scripts the responses of every device token without its own script
+const AnyDevice = fakescript.AnyDevice
+
+// defaultReasons are the APNs reasons of the scripted responses given without one
+var defaultReasons = map[int]string{
+	http.StatusBadRequest:            "BadDeviceToken",
+	http.StatusForbidden:             "InvalidProviderToken",
+	http.StatusGone:                  "Unregistered",
+	http.StatusRequestEntityTooLarge: "PayloadTooLarge",
+	http.StatusTooManyRequests:       "TooManyRequests",
+	http.StatusInternalServerError:   "InternalServerError",
+	http.StatusServiceUnavailable:    "ServiceUnavailable",
+}
+
+// Notification is a notification received by the fake gateway
+type Notification struct {
+	DeviceToken   string `json:"device_token"`
+	Topic         string `json:"topic"`
+	PushType      string `json:"push_type"`
+	Priority      string `json:"priority"`
+	Expiration    string `json:"expiration"`
+	CollapseID    string `json:"collapse_id"`
+	ApnsID        string `json:"apns_id"`
+	Authorization string `json:"authorization"`
+	// Common name of the client certificate, set on TLS connections with certificate authentication
+	ClientCertificate string          `json:"client_certificate"`
+	Payload           json.RawMessage `json:"payload"`
+}
+
+// Response is a scripted gateway response
+type Response struct {
+	StatusCode int
+	// APNs error reason, such as BadDeviceToken or TooManyRequests
+	Reason string
+	// Resets the stream without a response, so the push fails like on a broken connection
+	Drop bool
+}
+
+// Server is a fake APNs gateway
+type Server struct {
+	mu            sync.Mutex
+	notifications []Notification
+	responses     fakescript.Script[Response]
+}
+
+func New() *Server {
+	return &Server{}
+}
+
+// Script queues responses returned once each to the following pushes of the device token
+func (s *Server) Script(deviceToken string, responses ...Response) {
+	s.responses.Queue(deviceToken, responses...)
+}
+
+// Respond makes every push of the device token return the response once the scripted ones are used up
+func (s *Server) Respond(deviceToken string, response Response) {
+	s.responses.Fix(deviceToken, response)
+}
+
+// Notifications returns the notifications received so far
+func (s *Server) Notifications() []Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Notification(nil), s.notifications...)
+}
+
+// Reset clears the received notifications and all scripted responses
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifications = nil
+	s.responses.Reset()
+}
+
+// Handler returns the gateway handler serving HTTP/2 over cleartext (h2c)
+func (s *Server) Handler() http.Handler {
+	return h2c.NewHandler(s, &http2.Server{})
+}
+
+// ListenAndServe serves the gateway at the address, pushes are sent to http://addr
+func (s *Server) ListenAndServe(addr string) error {
+	return (&http.Server{Addr: addr, Handler: s.Handler()}).ListenAndServe()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, devicePathPrefix) && r.Method == http.MethodPost:
+		s.handlePush(w, r)
+	case r.URL.Path == "/notifications" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Notifications())
+	case r.URL.Path == "/notifications" && r.Method == http.MethodDelete:
+		s.Reset()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "PayloadEmpty")
+		return
+	}
+
+	apnsID := r.Header.Get("apns-id")
+	if apnsID == "" {
+		apnsID = shortuuid.New()
+	}
+	w.Header().Set("apns-id", apnsID)
+
+	n := Notification{
+		DeviceToken:   strings.TrimPrefix(r.URL.Path, devicePathPrefix),
+		Topic:         r.Header.Get("apns-topic"),
+		PushType:      r.Header.Get("apns-push-type"),
+		Priority:      r.Header.Get("apns-priority"),
+		Expiration:    r.Header.Get("apns-expiration"),
+		CollapseID:    r.Header.Get("apns-collapse-id"),
+		ApnsID:        apnsID,
+		Authorization: r.Header.Get("authorization"),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		n.ClientCertificate = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	switch {
+	case n.DeviceToken == "":
+		writeError(w, http.StatusBadRequest, "MissingDeviceToken")
+		return
+	case n.Topic == "":
+		writeError(w, http.StatusBadRequest, "MissingTopic")
+		return
+	case !json.Valid(body):
+		writeError(w, http.StatusBadRequest, "PayloadEmpty")
+		return
+	}
+	n.Payload = body
+
+	s.mu.Lock()
+	s.notifications = append(s.notifications, n)
+	resp := s.nextResponse(n.DeviceToken)
+	s.mu.Unlock()
+
+	if resp.Drop {
+		panic(http.ErrAbortHandler)
+	}
+	if resp.StatusCode == http.StatusOK {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeError(w, resp.StatusCode, resp.Reason)
+}
+
+// nextResponse pops the scripted response of the device token, the pushes succeed without one
+func (s *Server) nextResponse(deviceToken string) Response {
+	if resp, ok := s.responses.Next(deviceToken); ok {
+		return resp
+	}
+	return Response{StatusCode: http.StatusOK}
+}
+
+func writeError(w http.ResponseWriter, code int, reason string) {
+	resp := map[string]interface{}{"reason": reason}
+	if code == http.StatusGone {
+		// The last time APNs confirmed the token was no longer valid, in milliseconds
+		resp["timestamp"] = time.Now().UnixMilli()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ParseResponse parses a scripted response in the form of STATUS[:REASON], e.g. 410:Unregistered,
+// or "drop" to reset the stream
+func ParseResponse(s string) (Response, error) {
+	if s == "drop" {
+		return Response{Drop: true}, nil
+	}
+	status, reason, _ := strings.Cut(s, ":")
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 200 || code > 599 {
+		return Response{}, fmt.Errorf("invalid response status: %s", s)
+	}
+	resp := Response{StatusCode: code, Reason: reason}
+	if resp.Reason == "" && resp.StatusCode != http.StatusOK {
+		resp.Reason = defaultReasons[resp.StatusCode]
+	}
+	return resp, nil
+}
@@ -0,0 +1,123 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+const (
+	// Notifications are stored by APNs for 24 hours unless an expiration is given
+	defaultExpiration = 24 * time.Hour
+	// Maximum length of the apns-collapse-id header in bytes
+	collapseIDMaximum = 64
+	// Times from this unix timestamp on are absolute, smaller ones are relative seconds
+	absoluteTimeMinimum = 1_000_000_000
+)
+
+// supportedPushTypes are the push types of the app topic, the other push types are
+// delivered to topics of app extensions, which the apps of the profiles don't have
+var supportedPushTypes = map[apns2.EPushType]bool{
+	apns2.PushTypeAlert:      true,
+	apns2.PushTypeBackground: true,
+}
+
+// SetHeader sets an APNs request header parameter of the message:
+// priority (5 or 10), expiration (relative seconds, unix timestamp, RFC3339 date,
+// or 0 for "now or never"), collapse_id and push_type
+func (p *PushMessage) SetHeader(key, value string) error {
+	switch key {
+	case "priority":
+		priority, err := strconv.Atoi(value)
+		if err != nil || (priority != 1 && priority != apns2.PriorityLow && priority != apns2.PriorityHigh) {
+			return fmt.Errorf("invalid priority: %s, must be 1, 5 or 10", value)
+		}
+		p.Priority = priority
+	case "expiration":
+		expiration, err := parseExpiration(value, time.Now())
+		if err != nil {
+			return err
+		}
+		p.Expiration = expiration
+	case "collapse_id":
+		if len(value) > collapseIDMaximum {
+			return fmt.Errorf("invalid collapse_id: longer than %d bytes", collapseIDMaximum)
+		}
+		p.CollapseID = value
+	case "push_type":
+		pushType := apns2.EPushType(strings.ToLower(value))
+		if !supportedPushTypes[pushType] {
+			return fmt.Errorf("invalid push_type: %s, must be alert or background", value)
+		}
+		p.PushType = pushType
+	default:
+		return fmt.Errorf("unknown header parameter: %s", key)
+	}
+	return nil
+}
+
+// parseExpiration parses the expiration parameter, "0" returns the unix epoch meaning "now or never"
+func parseExpiration(value string, now time.Time) (time.Time, error) {
+	if value == "0" {
+		return time.Unix(0, 0), nil
+	}
+	t, err := ParseTime(value, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration: %v", err)
+	}
+	return t, nil
+}
+
+// ParseTime parses a time given as seconds from now, a unix timestamp or an RFC3339 date
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch {
+		case seconds <= 0:
+			return time.Time{}, fmt.Errorf("%s, must be positive", value)
+		case seconds < absoluteTimeMinimum:
+			return now.Add(time.Duration(seconds) * time.Second), nil
+		default:
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s, must be seconds, a unix timestamp or an RFC3339 date", value)
+}
+
+// immediateExpirationKey marks the pushes sent with "apns-expiration: 0"
+type immediateExpirationKey struct{}
+
+// headerTransport sends the headers apns2 can't express, apns2 omits the
+// apns-expiration header for the unix epoch instead of sending 0
+type headerTransport struct {
+	http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Context().Value(immediateExpirationKey{}) != nil {
+		r = r.Clone(r.Context())
+		r.Header.Set("apns-expiration", "0")
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	if closer, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// pushContext returns the context of the push request
+func pushContext(notification *apns2.Notification) context.Context {
+	if notification.Expiration.Equal(time.Unix(0, 0)) {
+		return context.WithValue(context.Background(), immediateExpirationKey{}, true)
+	}
+	return context.Background()
+}
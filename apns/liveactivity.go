@@ -0,0 +1,126 @@
+package apns
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// Live Activity events
+const (
+	LiveActivityStart  = "start"
+	LiveActivityUpdate = "update"
+	LiveActivityEnd    = "end"
+)
+
+// Live Activity pushes are sent to the app topic with this suffix
+const liveActivityTopicSuffix = ".push-type.liveactivity"
+
+// LiveActivityMessage starts, updates or ends a Live Activity
+type LiveActivityMessage struct {
+	// Push-to-start token for start events, activity push token otherwise
+	DeviceToken string
+	Environment string
+	Profile     string
+
+	Event string
+	// Dynamic content of the activity, decoded by the app into its ContentState
+	ContentState map[string]interface{}
+	// Name and static attributes of the ActivityAttributes type, start events only
+	AttributesType string
+	Attributes     map[string]interface{}
+	// The activity is displayed as outdated after StaleDate, an ended activity
+	// is removed from the lock screen at DismissalDate, zero values are omitted
+	StaleDate     time.Time
+	DismissalDate time.Time
+	// Optional alert shown with the update, required to start an activity
+	Title string
+	Body  string
+	Sound string
+	// APNs priority, defaults to 10
+	Priority int
+}
+
+// Validate checks the message is complete for its event
+func (m *LiveActivityMessage) Validate() error {
+	switch m.Event {
+	case LiveActivityStart:
+		if m.AttributesType == "" {
+			return fmt.Errorf("attributes_type is required to start a live activity")
+		}
+		if m.Title == "" && m.Body == "" {
+			return fmt.Errorf("title or body is required to start a live activity")
+		}
+	case LiveActivityUpdate, LiveActivityEnd:
+	default:
+		return fmt.Errorf("invalid live activity event: %s, must be start, update or end", m.Event)
+	}
+	if m.ContentState == nil {
+		return fmt.Errorf("content_state is required")
+	}
+	if m.Priority != 0 && m.Priority != apns2.PriorityLow && m.Priority != apns2.PriorityHigh {
+		return fmt.Errorf("invalid priority: %d, must be 5 or 10", m.Priority)
+	}
+	return nil
+}
+
+// PushLiveActivity sends a Live Activity push through the client pool of the device
+func PushLiveActivity(msg *LiveActivityMessage) (*PushResult, error) {
+	if err := msg.Validate(); err != nil {
+		return &PushResult{StatusCode: 400}, err
+	}
+
+	pl := payload.NewPayload().
+		SetEvent(payload.ELiveActivityEvent(msg.Event)).
+		SetTimestamp(time.Now().Unix()).
+		SetContentState(msg.ContentState)
+	if msg.Event == LiveActivityStart {
+		pl = pl.SetAttributesType(msg.AttributesType).SetAttributes(msg.Attributes)
+	}
+	if !msg.StaleDate.IsZero() {
+		pl = pl.SetStaleDate(msg.StaleDate.Unix())
+	}
+	if !msg.DismissalDate.IsZero() {
+		pl = pl.SetDismissalDate(msg.DismissalDate.Unix())
+	}
+	if msg.Title != "" || msg.Body != "" {
+		pl = pl.AlertTitle(msg.Title).AlertBody(msg.Body)
+		if msg.Sound != "" {
+			pl = pl.Sound(msg.Sound)
+		}
+	}
+	np := &notificationPayload{Payload: pl}
+	size, err := payloadSize(np)
+	if err != nil {
+		return &PushResult{StatusCode: http.StatusBadRequest}, err
+	}
+	if size > PayloadMaximum {
+		return &PushResult{StatusCode: http.StatusRequestEntityTooLarge}, fmt.Errorf("payload too large: %d bytes, the maximum is %d bytes", size, PayloadMaximum)
+	}
+
+	priority := msg.Priority
+	if priority == 0 {
+		priority = apns2.PriorityHigh
+	}
+
+	pc, err := lookupProfile(msg.Profile)
+	if err != nil {
+		return &PushResult{StatusCode: 400}, err
+	}
+	env, err := ParseEnvironment(msg.Environment)
+	if err != nil {
+		return &PushResult{StatusCode: 400}, err
+	}
+
+	return send(pc.pools[env], pc.retryPolicy, &apns2.Notification{
+		DeviceToken: msg.DeviceToken,
+		Topic:       pc.topic + liveActivityTopicSuffix,
+		Payload:     np,
+		Priority:    priority,
+		Expiration:  time.Now().Add(defaultExpiration),
+		PushType:    apns2.PushTypeLiveActivity,
+	})
+}
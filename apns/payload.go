@@ -0,0 +1,131 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Handling of the payloads larger than PayloadMaximum
+const (
+	// PayloadModeReject fails the push with 413
+	PayloadModeReject = "reject"
+	// PayloadModeTruncate shortens the body with an ellipsis until the payload fits
+	PayloadModeTruncate = "truncate"
+)
+
+const ellipsis = "…"
+
+func validatePayloadMode(mode string) error {
+	switch mode {
+	case PayloadModeReject, PayloadModeTruncate:
+		return nil
+	default:
+		return fmt.Errorf("invalid apns payload mode: %s, must be %s or %s", mode, PayloadModeReject, PayloadModeTruncate)
+	}
+}
+
+// fitPayload enforces PayloadMaximum on the payload, in truncate mode the alert body
+// is cut at a character boundary, the title, group and custom fields are kept as is
+func fitPayload(pl *notificationPayload, body string, payloadMode string) error {
+	size, err := payloadSize(pl)
+	if err != nil {
+		return err
+	}
+	if size <= PayloadMaximum {
+		return nil
+	}
+
+	if payloadMode == PayloadModeTruncate && body != "" {
+		runes := []rune(body)
+		truncated := func(n int) string {
+			return strings.TrimRightFunc(string(runes[:n]), unicode.IsSpace) + ellipsis
+		}
+		// The shortest body prefix that doesn't fit, the escaping makes the size nonlinear
+		n := sort.Search(len(runes), func(n int) bool {
+			pl.AlertBody(truncated(n))
+			s, err := payloadSize(pl)
+			return err != nil || s > PayloadMaximum
+		})
+		if n > 0 {
+			pl.AlertBody(truncated(n - 1))
+			return nil
+		}
+		pl.AlertBody(body)
+	}
+	return fmt.Errorf("payload too large: %d bytes, the maximum is %d bytes", size, PayloadMaximum)
+}
+
+func payloadSize(pl *notificationPayload) (int, error) {
+	b, err := json.Marshal(pl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	return len(b), nil
+}
+
+// ParseBadge parses the badge parameter, a non-negative integer given as a number or a string
+func ParseBadge(val interface{}) (int, error) {
+	var badge float64
+	switch val := val.(type) {
+	case float64:
+		badge = val
+	case int:
+		badge = float64(val)
+	case string:
+		b, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return 0, fmt.Errorf("invalid badge: %s", val)
+		}
+		badge = float64(b)
+	default:
+		return 0, fmt.Errorf("invalid badge: %v", val)
+	}
+	if badge < 0 || badge != math.Trunc(badge) || badge > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid badge: %v", val)
+	}
+	return int(badge), nil
+}
+
+// ParseSound validates the sound dictionary of the aps payload:
+// {"critical": 1, "name": "alarm.caf", "volume": 0.5}
+func ParseSound(dict map[string]interface{}) (map[string]interface{}, error) {
+	sound := make(map[string]interface{}, len(dict))
+	for k, v := range dict {
+		switch k {
+		case "critical":
+			switch v {
+			case true, 1.0, "1":
+				sound[k] = 1
+			case false, 0.0, "0":
+				sound[k] = 0
+			default:
+				return nil, fmt.Errorf("invalid sound critical: %v", v)
+			}
+		case "name":
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid sound name: %v", v)
+			}
+			sound[k] = name
+		case "volume":
+			volume, ok := v.(float64)
+			if s, isString := v.(string); isString {
+				var err error
+				volume, err = strconv.ParseFloat(s, 64)
+				ok = err == nil
+			}
+			if !ok || volume < 0 || volume > 1 {
+				return nil, fmt.Errorf("invalid sound volume: %v, must be between 0 and 1", v)
+			}
+			sound[k] = volume
+		default:
+			return nil, fmt.Errorf("unknown sound field: %s", k)
+		}
+	}
+	return sound, nil
+}
@@ -0,0 +1,195 @@
+package apns
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mritd/logger"
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// A client is recreated after this many consecutive connection errors
+	maxConsecutiveErrors = 3
+	// Idle HTTP/2 connections are health checked with a ping after this period,
+	// and closed if the ping is not answered within pingTimeout
+	readIdleTimeout = time.Minute
+	pingTimeout     = 15 * time.Second
+)
+
+// pooledClient is a client of a pool, every client owns its own HTTP/2 connection
+type pooledClient struct {
+	id     int
+	client atomic.Pointer[apns2.Client]
+
+	inFlight          atomic.Int64
+	sent              atomic.Uint64
+	rejected          atomic.Uint64
+	errors            atomic.Uint64
+	consecutiveErrors atomic.Int64
+	recreated         atomic.Uint64
+}
+
+// clientPool balances the pushes across its clients by the least outstanding requests
+type clientPool struct {
+	profile     string
+	environment string
+	newClient   func() *apns2.Client
+	clients     []*pooledClient
+	// rotates the start of the least outstanding search to spread the ties
+	next     atomic.Uint64
+	recreate sync.Mutex
+}
+
+// ClientStats are the usage statistics of an APNs client
+type ClientStats struct {
+	Profile     string `json:"profile"`
+	Environment string `json:"environment"`
+	ID          int    `json:"id"`
+	InFlight    int64  `json:"in_flight"`
+	// Pushes accepted by APNs
+	Sent uint64 `json:"sent"`
+	// Pushes rejected by APNs
+	Rejected uint64 `json:"rejected"`
+	// Connection errors
+	Errors uint64 `json:"errors"`
+	// Times the client was recreated after consecutive connection errors
+	Recreated uint64 `json:"recreated"`
+}
+
+func newClientPool(profile, environment string, size int, newClient func() *apns2.Client) *clientPool {
+	p := &clientPool{
+		profile:     profile,
+		environment: environment,
+		newClient:   newClient,
+		clients:     make([]*pooledClient, size),
+	}
+	for i := range p.clients {
+		c := &pooledClient{id: i}
+		c.client.Store(newClient())
+		p.clients[i] = c
+		logger.Infof("create %s apns client of profile [%s]: %d", environment, profile, i)
+	}
+	return p
+}
+
+// acquire returns the client with the fewest in-flight pushes
+func (p *clientPool) acquire() *pooledClient {
+	start := int(p.next.Add(1) % uint64(len(p.clients)))
+	best := p.clients[start]
+	for i := 1; i < len(p.clients) && best.inFlight.Load() > 0; i++ {
+		c := p.clients[(start+i)%len(p.clients)]
+		if c.inFlight.Load() < best.inFlight.Load() {
+			best = c
+		}
+	}
+	return best
+}
+
+// push sends the notification with the least busy client
+func (p *clientPool) push(notification *apns2.Notification) (*apns2.Response, error) {
+	c := p.acquire()
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+
+	resp, err := c.client.Load().PushWithContext(pushContext(notification), notification)
+	if err != nil {
+		c.errors.Add(1)
+		if c.consecutiveErrors.Add(1) >= maxConsecutiveErrors {
+			p.recreateClient(c)
+		}
+		return nil, err
+	}
+
+	c.consecutiveErrors.Store(0)
+	if resp.Sent() {
+		c.sent.Add(1)
+	} else {
+		c.rejected.Add(1)
+	}
+	return resp, nil
+}
+
+// recreateClient replaces the client whose connection is considered dead,
+// in-flight pushes of the old client complete on their own
+func (p *clientPool) recreateClient(c *pooledClient) {
+	p.recreate.Lock()
+	defer p.recreate.Unlock()
+	if c.consecutiveErrors.Load() < maxConsecutiveErrors {
+		// Already recreated by another push
+		return
+	}
+
+	old := c.client.Swap(p.newClient())
+	c.consecutiveErrors.Store(0)
+	c.recreated.Add(1)
+	closeClient(old)
+	logger.Warnf("recreate %s apns client of profile [%s]: %d", p.environment, p.profile, c.id)
+}
+
+// close closes the connections of the pool's clients
+func (p *clientPool) close() {
+	for _, c := range p.clients {
+		closeClient(c.client.Load())
+	}
+}
+
+// closeClient closes the idle connections of the client
+func closeClient(client *apns2.Client) {
+	client.HTTPClient.CloseIdleConnections()
+}
+
+// stats returns the statistics of every client of the pool
+func (p *clientPool) stats() []ClientStats {
+	stats := make([]ClientStats, len(p.clients))
+	for i, c := range p.clients {
+		stats[i] = ClientStats{
+			Profile:     p.profile,
+			Environment: p.environment,
+			ID:          c.id,
+			InFlight:    c.inFlight.Load(),
+			Sent:        c.sent.Load(),
+			Rejected:    c.rejected.Load(),
+			Errors:      c.errors.Load(),
+			Recreated:   c.recreated.Load(),
+		}
+	}
+	return stats
+}
+
+// Stats returns the statistics of every APNs client
+func Stats() []ClientStats {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	var stats []ClientStats
+	for _, pc := range clients {
+		for _, pool := range pc.pools {
+			stats = append(stats, pool.stats()...)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Profile != stats[j].Profile {
+			return stats[i].Profile < stats[j].Profile
+		}
+		if stats[i].Environment != stats[j].Environment {
+			return stats[i].Environment < stats[j].Environment
+		}
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// newHTTPClient returns the HTTP client of an APNs client, with health checks of its connection
+func newHTTPClient(transport *http2.Transport) *http.Client {
+	transport.ReadIdleTimeout = readIdleTimeout
+	transport.PingTimeout = pingTimeout
+	return &http.Client{
+		Transport: &headerTransport{transport},
+		Timeout:   apns2.HTTPClientTimeout,
+	}
+}
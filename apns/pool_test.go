@@ -0,0 +1,83 @@
+package apns
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/finb/bark-server/v2/apns/fakeapns"
+	"github.com/sideshow/apns2"
+)
+
+func TestAcquire(t *testing.T) {
+	pool := newClientPool(DefaultProfile, EnvironmentProduction, 3, func() *apns2.Client {
+		return &apns2.Client{HTTPClient: &http.Client{}}
+	})
+
+	// The ties are spread across the clients
+	seen := map[int]bool{}
+	for range pool.clients {
+		seen[pool.acquire().id] = true
+	}
+	if len(seen) != len(pool.clients) {
+		t.Fatalf("want every idle client to be used, got %v", seen)
+	}
+
+	pool.clients[0].inFlight.Store(2)
+	pool.clients[1].inFlight.Store(1)
+	pool.clients[2].inFlight.Store(3)
+	for range pool.clients {
+		if c := pool.acquire(); c.id != 1 {
+			t.Fatalf("want the client with the fewest in-flight pushes, got %d", c.id)
+		}
+	}
+}
+
+func TestRecreateClient(t *testing.T) {
+	gateways := useGateways(t)
+	gateway := gateways[EnvironmentProduction]
+	cfg := DefaultConfig()
+	cfg.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+	if err := ReCreateAPNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := lookupProfile(DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := pc.pools[EnvironmentProduction].clients[0]
+	client := c.client.Load()
+
+	push := func() error {
+		_, err := Push(&PushMessage{DeviceToken: testDeviceToken, Body: "body"})
+		return err
+	}
+
+	// A successful push resets the count of consecutive errors
+	drop := fakeapns.Response{Drop: true}
+	gateway.Script(testDeviceToken, drop, drop, fakeapns.Response{StatusCode: http.StatusOK}, drop, drop)
+	for i := 0; i < 5; i++ {
+		_ = push()
+	}
+	if c.client.Load() != client || c.recreated.Load() != 0 {
+		t.Fatal("client recreated without consecutive errors")
+	}
+	if c.errors.Load() != 4 || c.consecutiveErrors.Load() != 2 {
+		t.Fatalf("want 4 errors with 2 consecutive, got %d with %d", c.errors.Load(), c.consecutiveErrors.Load())
+	}
+
+	gateway.Script(testDeviceToken, drop)
+	if err := push(); err == nil {
+		t.Fatal("want connection error")
+	}
+	if c.client.Load() == client || c.recreated.Load() != 1 || c.consecutiveErrors.Load() != 0 {
+		t.Fatalf("want the client recreated after %d consecutive errors", maxConsecutiveErrors)
+	}
+
+	// The new client connects again
+	if err := push(); err != nil {
+		t.Fatal(err)
+	}
+	if c.sent.Load() != 2 {
+		t.Fatalf("want 2 sent, got %d", c.sent.Load())
+	}
+}
@@ -0,0 +1,257 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mritd/logger"
+	"github.com/sideshow/apns2/certificate"
+)
+
+const (
+	// Credentials of the official Bark app, used when no custom key is configured
+	defaultTopic  = "me.fin.bark"
+	defaultKeyID  = "LH4T9V5U4R"
+	defaultTeamID = "5U8LBRXG3A"
+
+	// DefaultProfile is used by the devices registered without a profile
+	DefaultProfile = "default"
+
+	// Certificates expiring within this period are warned at startup
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+// Authentication types of a profile
+const (
+	AuthTypeToken       = "token"
+	AuthTypeCertificate = "certificate"
+)
+
+// OID of the subject UID attribute, APNs certificates carry the bundle ID in it
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// Profile is a named set of APNs credentials of one build of the app
+type Profile struct {
+	Name string `json:"name"`
+	// AuthTypeToken (default) or AuthTypeCertificate
+	AuthType string `json:"auth_type"`
+	// Path to the .p8 private key file, the embedded Bark key is used if empty
+	KeyFile string `json:"key_file"`
+	KeyID   string `json:"key_id"`
+	TeamID  string `json:"team_id"`
+	// Bundle ID of the app receiving the notifications,
+	// read from the certificate if empty in certificate mode
+	Topic string `json:"topic"`
+	// Path to the .p12 or .pem push certificate used in certificate mode
+	CertFile     string `json:"cert_file"`
+	CertPassword string `json:"cert_password"`
+}
+
+// Config holds the APNs credential profiles
+type Config struct {
+	// Must contain the DefaultProfile
+	Profiles       []Profile
+	MaxClientCount int
+	// Overrides the APNs gateway of all environments, http:// hosts are
+	// connected with HTTP/2 over cleartext, such as the fake APNs server
+	Host string
+	// Proxy of the APNs connections: http://, https:// or socks5:// URL,
+	// the credentials of the URL are used for the proxy authentication
+	Proxy string
+	// Retries of the transient failures, the zero value means DefaultRetryPolicy()
+	RetryPolicy RetryPolicy
+	// Handling of the payloads larger than PayloadMaximum, PayloadModeTruncate if empty
+	PayloadMode string
+}
+
+// DefaultConfig returns the configuration of the official Bark app
+func DefaultConfig() Config {
+	return Config{
+		Profiles: []Profile{{
+			Name:   DefaultProfile,
+			KeyID:  defaultKeyID,
+			TeamID: defaultTeamID,
+			Topic:  defaultTopic,
+		}},
+		MaxClientCount: 1,
+		RetryPolicy:    DefaultRetryPolicy(),
+		PayloadMode:    PayloadModeTruncate,
+	}
+}
+
+// LoadProfiles reads the additional credential profiles from a JSON file:
+// [{"name": "...", "key_file": "...", "key_id": "...", "team_id": "...", "topic": "..."},
+// {"name": "...", "auth_type": "certificate", "cert_file": "...", "cert_password": "...", "topic": "..."}]
+func LoadProfiles(path string) ([]Profile, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apns profiles: %v", err)
+	}
+
+	var profiles []Profile
+	if err = json.Unmarshal(bs, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse apns profiles: %v", err)
+	}
+	return profiles, nil
+}
+
+// ParseProfile normalizes the profile of a device registration, empty means the default profile
+func ParseProfile(name string) (string, error) {
+	if name == "" {
+		return DefaultProfile, nil
+	}
+	if _, err := lookupProfile(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// validate checks the configuration and fills in the defaults of the embedded Bark key
+func (cfg *Config) validate() error {
+	if cfg.MaxClientCount < 1 {
+		return fmt.Errorf("invalid number of clients")
+	}
+
+	names := make(map[string]bool, len(cfg.Profiles))
+	for i := range cfg.Profiles {
+		p := &cfg.Profiles[i]
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate apns profile: %s", p.Name)
+		}
+		names[p.Name] = true
+	}
+	if !names[DefaultProfile] {
+		return fmt.Errorf("apns profile [%s] is required", DefaultProfile)
+	}
+	if cfg.Proxy != "" {
+		if _, err := newProxyDialer(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+
+	if cfg.RetryPolicy == (RetryPolicy{}) {
+		cfg.RetryPolicy = DefaultRetryPolicy()
+	}
+	if err := cfg.RetryPolicy.validate(); err != nil {
+		return err
+	}
+	if cfg.PayloadMode == "" {
+		cfg.PayloadMode = PayloadModeTruncate
+	}
+	return validatePayloadMode(cfg.PayloadMode)
+}
+
+// validate checks the profile and fills in the defaults of the embedded Bark key
+func (p *Profile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("apns profile name is empty")
+	}
+
+	switch p.AuthType {
+	case "":
+		p.AuthType = AuthTypeToken
+	case AuthTypeToken:
+	case AuthTypeCertificate:
+		if p.CertFile == "" {
+			return fmt.Errorf("apns certificate file of profile [%s] is required", p.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid apns auth type of profile [%s]: %s", p.Name, p.AuthType)
+	}
+
+	if p.KeyFile == "" {
+		if p.Name != DefaultProfile {
+			return fmt.Errorf("apns key file of profile [%s] is required", p.Name)
+		}
+		if (p.KeyID != "" && p.KeyID != defaultKeyID) ||
+			(p.TeamID != "" && p.TeamID != defaultTeamID) ||
+			(p.Topic != "" && p.Topic != defaultTopic) {
+			return fmt.Errorf("apns key file is required when using a custom key id, team id or topic")
+		}
+		p.KeyID, p.TeamID, p.Topic = defaultKeyID, defaultTeamID, defaultTopic
+		return nil
+	}
+
+	if p.KeyID == "" {
+		return fmt.Errorf("apns key id of profile [%s] is required", p.Name)
+	}
+	if p.TeamID == "" {
+		return fmt.Errorf("apns team id of profile [%s] is required", p.Name)
+	}
+	if p.Topic == "" {
+		return fmt.Errorf("apns topic of profile [%s] is required", p.Name)
+	}
+	return nil
+}
+
+// loadAuthKey returns the private key content of the profile
+func (p *Profile) loadAuthKey() ([]byte, error) {
+	if p.KeyFile == "" {
+		return []byte(apnsPrivateKey), nil
+	}
+	return os.ReadFile(p.KeyFile)
+}
+
+// loadCertificate loads the push certificate of the profile, fills in the topic
+// from the certificate if needed and warns about the certificate expiry
+func (p *Profile) loadCertificate() (tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	switch strings.ToLower(filepath.Ext(p.CertFile)) {
+	case ".p12", ".pfx":
+		cert, err = certificate.FromP12File(p.CertFile, p.CertPassword)
+	default:
+		cert, err = certificate.FromPemFile(p.CertFile, p.CertPassword)
+	}
+	if err != nil {
+		return cert, fmt.Errorf("failed to load APNS certificate of profile [%s]: %v", p.Name, err)
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return cert, fmt.Errorf("failed to parse APNS certificate of profile [%s]: %v", p.Name, err)
+		}
+	}
+
+	if p.Topic == "" {
+		for _, name := range leaf.Subject.Names {
+			if name.Type.Equal(oidUserID) {
+				p.Topic, _ = name.Value.(string)
+			}
+		}
+		if p.Topic == "" {
+			return cert, fmt.Errorf("apns topic of profile [%s] is required", p.Name)
+		}
+	}
+
+	if warning := expiryWarning(p.Name, leaf.NotAfter, time.Now()); warning != "" {
+		logger.Warn(warning)
+	}
+	return cert, nil
+}
+
+// expiryWarning returns the warning about a certificate expired or expiring soon, empty otherwise
+func expiryWarning(profile string, notAfter, now time.Time) string {
+	remaining := notAfter.Sub(now)
+	switch {
+	case remaining <= 0:
+		return fmt.Sprintf("APNS certificate of profile [%s] expired at %s", profile, notAfter.Format(time.RFC3339))
+	case remaining < certExpiryWarning:
+		return fmt.Sprintf("APNS certificate of profile [%s] expires in %d days at %s",
+			profile, int(remaining.Hours()/24), notAfter.Format(time.RFC3339))
+	default:
+		return ""
+	}
+}
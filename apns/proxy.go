@@ -0,0 +1,149 @@
+package apns
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/proxy"
+)
+
+// Default ports of the proxy schemes
+var proxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// proxyDialer dials the APNs connections through an HTTP CONNECT or SOCKS5 proxy,
+// the credentials of the proxy URL are used for the proxy authentication
+type proxyDialer struct {
+	proxy  *url.URL
+	dialer *net.Dialer
+}
+
+func newProxyDialer(rawURL string) (*proxyDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apns proxy: %v", err)
+	}
+	port, ok := proxyPorts[u.Scheme]
+	if !ok || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid apns proxy: %s, must be an http://, https:// or socks5:// URL", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return &proxyDialer{
+		proxy: u,
+		dialer: &net.Dialer{
+			Timeout:   apns2.TLSDialTimeout,
+			KeepAlive: apns2.TCPKeepAlive,
+		},
+	}, nil
+}
+
+// Dial connects to the address through the proxy
+func (d *proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.proxy.Scheme == "socks5" || d.proxy.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if d.proxy.User != nil {
+			password, _ := d.proxy.User.Password()
+			auth = &proxy.Auth{User: d.proxy.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", d.proxy.Host, auth, d.dialer)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.Dial(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s: %v", d.proxy.Host, err)
+		}
+		return conn, nil
+	}
+	return d.connect(addr)
+}
+
+// DialTLS connects to the address through the proxy and starts TLS on the tunnel
+func (d *proxyDialer) DialTLS(network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apns2.TLSDialTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connect opens a tunnel to the address with an HTTP CONNECT request
+func (d *proxyDialer) connect(addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial("tcp", d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %v", d.proxy.Host, err)
+	}
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+	_ = conn.SetDeadline(time.Now().Add(apns2.TLSDialTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %v", d.proxy.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %v", d.proxy.Host, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s: CONNECT %s failed: %s", d.proxy.Host, addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		// Bytes the proxy sent after the response belong to the tunnel
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes buffered while reading the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
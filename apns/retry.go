@@ -0,0 +1,75 @@
+package apns
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// RetryPolicy controls the retries of transient APNs failures: connection errors,
+// 429 TooManyRequests, 500 InternalServerError and 503 ServiceUnavailable.
+// Permanent errors such as BadDeviceToken are never retried.
+type RetryPolicy struct {
+	// Total attempts of a push including the first one, 1 disables retries
+	MaxAttempts int
+	// Delay before the first retry, doubled after every retry
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Randomizes every delay by ±Jitter of its length, between 0 and 1
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the retry policy used unless configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+		Jitter:      0.2,
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("invalid number of apns push attempts: %d", p.MaxAttempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("invalid apns retry backoff")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("invalid apns retry jitter: %v", p.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait before the retry following the given attempt
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// retryable reports whether a failed push may succeed when sent again,
+// resp is nil when the push failed with a connection error
+func retryable(resp *apns2.Response) bool {
+	if resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,10 +1,14 @@
 package database
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/lithammer/shortuuid/v3"
 	"github.com/mritd/logger"
@@ -19,7 +23,11 @@ var dbOnce sync.Once
 var db *bbolt.DB
 
 const (
-	bucketName = "device"
+	bucketName         = "device"
+	deliveryBucketName = "delivery"
+	// Index of the deliveries ordered by time, the keys are the big-endian
+	// creation time followed by the key of the delivery
+	deliveryTimeBucketName = "delivery_time"
 )
 
 func NewBboltdb(dataDir string) Database {
@@ -48,29 +56,38 @@ func (d *BboltDB) Close() error {
 	return db.Close()
 }
 
-// DeviceTokenByKey get device token of specified key
-func (d *BboltDB) DeviceTokenByKey(key string) (string, error) {
-	var token string
+// DeviceByKey get device of specified key
+func (d *BboltDB) DeviceByKey(key string) (*Device, error) {
+	device, err := d.StoredDevice(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(device.Token) == 0 {
+		return nil, fmt.Errorf("device token invalid")
+	}
+	return device, nil
+}
+
+// StoredDevice returns the device record of the key as stored, without validating its token
+func (d *BboltDB) StoredDevice(key string) (*Device, error) {
+	var device *Device
 	err := db.View(func(tx *bbolt.Tx) error {
-		if bs := tx.Bucket([]byte(bucketName)).Get([]byte(key)); bs == nil {
+		bs := tx.Bucket([]byte(bucketName)).Get([]byte(key))
+		if bs == nil {
 			return fmt.Errorf("failed to get [%s] device token from database", key)
-		} else {
-			token = string(bs)
-			if len(token) == 0 {
-				return fmt.Errorf("device token invalid")
-			}
-			return nil
 		}
+		var err error
+		device, err = decodeDevice(bs)
+		return err
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return token, nil
+	return device, nil
 }
 
-// SaveDeviceToken create or update device token of specified key
-func (d *BboltDB) SaveDeviceTokenByKey(key, deviceToken string) (string, error) {
+// SaveDevice create or update device of specified key
+func (d *BboltDB) SaveDevice(key string, device *Device) (string, error) {
 	err := db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
 
@@ -81,8 +98,13 @@ func (d *BboltDB) SaveDeviceTokenByKey(key, deviceToken string) (string, error)
 			key = shortuuid.New()
 		}
 
-		// update the deviceToken
-		return bucket.Put([]byte(key), []byte(deviceToken))
+		bs, err := json.Marshal(device)
+		if err != nil {
+			return err
+		}
+
+		// update the device
+		return bucket.Put([]byte(key), bs)
 	})
 
 	if err != nil {
@@ -92,6 +114,29 @@ func (d *BboltDB) SaveDeviceTokenByKey(key, deviceToken string) (string, error)
 	return key, nil
 }
 
+// UpdateDevice updates the stored device of the key within a single transaction
+func (d *BboltDB) UpdateDevice(key string, update func(device *Device) bool) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		bs := bucket.Get([]byte(key))
+		if bs == nil {
+			return fmt.Errorf("failed to get [%s] device token from database", key)
+		}
+		device, err := decodeDevice(bs)
+		if err != nil {
+			return err
+		}
+		if !update(device) {
+			return nil
+		}
+		bs, err = json.Marshal(device)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), bs)
+	})
+}
+
 // DeleteDeviceByKey delete device of specified key
 func (d *BboltDB) DeleteDeviceByKey(key string) error {
 	err := db.Update(func(tx *bbolt.Tx) error {
@@ -101,6 +146,19 @@ func (d *BboltDB) DeleteDeviceByKey(key string) error {
 	return err
 }
 
+// decodeDevice decodes a stored device, older versions stored the raw device token only
+func decodeDevice(bs []byte) (*Device, error) {
+	if len(bs) == 0 || bs[0] != '{' {
+		return &Device{Token: string(bs)}, nil
+	}
+
+	var device Device
+	if err := json.Unmarshal(bs, &device); err != nil {
+		return nil, fmt.Errorf("failed to decode device: %v", err)
+	}
+	return &device, nil
+}
+
 // bboltSetup setup the bbolt database
 func bboltSetup(dataDir string) {
 	dbOnce.Do(func() {
@@ -118,8 +176,15 @@ func bboltSetup(dataDir string) {
 			logger.Fatalf("failed to create database file(%s): %v", filepath.Join(dataDir, "bark.db"), err)
 		}
 		err = bboltDB.Update(func(tx *bbolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-			return err
+			for _, name := range []string{bucketName, deliveryBucketName} {
+				if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			if tx.Bucket([]byte(deliveryTimeBucketName)) == nil {
+				return createDeliveryTimeIndex(tx)
+			}
+			return nil
 		})
 		if err != nil {
 			logger.Fatalf("failed to create database bucket: %v", err)
@@ -127,3 +192,86 @@ func bboltSetup(dataDir string) {
 		db = bboltDB
 	})
 }
+
+// deliveryKey orders the deliveries by message id, the apns-id is unique per notification
+func deliveryKey(delivery *Delivery) []byte {
+	return []byte(delivery.ID + "\x00" + delivery.ApnsID)
+}
+
+// deliveryTimeKey orders the deliveries by creation time in the time index
+func deliveryTimeKey(createdAt int64, key []byte) []byte {
+	k := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(createdAt))
+	return append(k, key...)
+}
+
+// createDeliveryTimeIndex indexes the deliveries logged by the versions without time index
+func createDeliveryTimeIndex(tx *bbolt.Tx) error {
+	index, err := tx.CreateBucket([]byte(deliveryTimeBucketName))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(deliveryBucketName)).ForEach(func(k, v []byte) error {
+		var delivery Delivery
+		// Undecodable deliveries are indexed as the oldest, so they are pruned first
+		_ = json.Unmarshal(v, &delivery)
+		return index.Put(deliveryTimeKey(delivery.CreatedAt, k), nil)
+	})
+}
+
+// SaveDelivery append the delivery to the log
+func (d *BboltDB) SaveDelivery(delivery *Delivery) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		bs, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		key := deliveryKey(delivery)
+		if err := tx.Bucket([]byte(deliveryBucketName)).Put(key, bs); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(deliveryTimeBucketName)).Put(deliveryTimeKey(delivery.CreatedAt, key), nil)
+	})
+}
+
+// DeliveriesByID get the deliveries of the message id
+func (d *BboltDB) DeliveriesByID(id string) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := db.View(func(tx *bbolt.Tx) error {
+		prefix := []byte(id + "\x00")
+		c := tx.Bucket([]byte(deliveryBucketName)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var delivery Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return fmt.Errorf("failed to decode delivery: %v", err)
+			}
+			deliveries = append(deliveries, &delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// PruneDeliveries delete the deliveries older than the time, the time index
+// is walked from the oldest delivery up to the first one retained
+func (d *BboltDB) PruneDeliveries(before time.Time) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(deliveryBucketName))
+		index := tx.Bucket([]byte(deliveryTimeBucketName))
+		limit := deliveryTimeKey(before.Unix(), nil)
+		var expired [][]byte
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
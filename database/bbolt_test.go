@@ -0,0 +1,35 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBboltDeliveryLog(t *testing.T) {
+	log := NewBboltdb(t.TempDir()).(DeliveryLog)
+	now := time.Now()
+	for i, delivery := range []Delivery{
+		{ID: "old", ApnsID: "apns-1", StatusCode: 200, CreatedAt: now.Add(-48 * time.Hour).Unix()},
+		{ID: "new", ApnsID: "apns-2", StatusCode: 200, CreatedAt: now.Add(-time.Hour).Unix()},
+		{ID: "old", ApnsID: "apns-3", StatusCode: 410, CreatedAt: now.Unix()},
+	} {
+		if err := log.SaveDelivery(&delivery); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+
+	if deliveries, err := log.DeliveriesByID("old"); err != nil || len(deliveries) != 2 {
+		t.Fatalf("want 2 deliveries, got %v, %v", deliveries, err)
+	}
+
+	if err := log.PruneDeliveries(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := log.DeliveriesByID("old")
+	if err != nil || len(deliveries) != 1 || deliveries[0].ApnsID != "apns-3" {
+		t.Fatalf("want the retained delivery only, got %v, %v", deliveries, err)
+	}
+	if deliveries, err := log.DeliveriesByID("new"); err != nil || len(deliveries) != 1 {
+		t.Fatalf("want 1 delivery, got %v, %v", deliveries, err)
+	}
+}
@@ -1,10 +1,79 @@
 package database
 
+import (
+	"time"
+)
+
+// Device is a registered device and its push settings
+type Device struct {
+	// APNs device token, FCM registration token, Web Push subscription endpoint or webhook URL
+	Token string `json:"token"`
+	// Platform of the device, ios, android, web or webhook, empty means ios
+	Platform string `json:"platform,omitempty"`
+	// Target of the webhook devices
+	Webhook *WebhookTarget `json:"webhook,omitempty"`
+	// Email address the pushes are sent to when they can't be delivered to the device
+	FallbackEmail string `json:"fallback_email,omitempty"`
+	// Secret verifying the requests of the GitHub and GitLab webhook receivers
+	ReceiverSecret string `json:"receiver_secret,omitempty"`
+	// Browser keys of the Web Push subscription, URL-safe base64
+	WebPushP256dh string `json:"webpush_p256dh,omitempty"`
+	WebPushAuth   string `json:"webpush_auth,omitempty"`
+	// APNs environment of the device, empty means production
+	Environment string `json:"environment,omitempty"`
+	// APNs credential profile of the device, empty means the default profile
+	Profile string `json:"profile,omitempty"`
+	// Push token of the running Live Activity
+	ActivityToken string `json:"activity_token,omitempty"`
+	// Push-to-start token starting new Live Activities, iOS 17.2 or later
+	ActivityStartToken string `json:"activity_start_token,omitempty"`
+	// Unix time the token was registered, 0 for devices registered by older versions
+	RegisteredAt int64 `json:"registered_at,omitempty"`
+	// Unix time APNs reported the token invalid and the APNs reason, the token is
+	// kept but not pushed to until the device registers again
+	InvalidatedAt int64  `json:"invalidated_at,omitempty"`
+	InvalidReason string `json:"invalid_reason,omitempty"`
+	// Unix time of the first push the push service accepted for the token, 0 until then
+	DeliveredAt int64 `json:"delivered_at,omitempty"`
+}
+
+// WebhookTarget is the stored webhook target of a device, as registered to /webhook/register
+type WebhookTarget struct {
+	URL          string            `json:"url"`
+	Method       string            `json:"method,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	BodyTemplate string            `json:"body_template,omitempty"`
+	Secret       string            `json:"secret,omitempty"`
+}
+
+// Invalidate marks the token invalid as reported by APNs at the time, it returns false
+// when the token was registered again after that time and is kept valid
+func (d *Device) Invalidate(at time.Time, reason string) bool {
+	if d.RegisteredAt > at.Unix() {
+		return false
+	}
+	d.InvalidatedAt = at.Unix()
+	d.InvalidReason = reason
+	return true
+}
+
+// IsInvalidated reports whether APNs reported the token invalid
+func (d *Device) IsInvalidated() bool {
+	return d.InvalidatedAt != 0
+}
+
+// Reloader is implemented by the databases able to reload their TLS material
+type Reloader interface {
+	Reload() error
+}
+
 // Database defines all of the db operation
 type Database interface {
-	CountAll() (int, error)                                 //Get db records count
-	DeviceTokenByKey(key string) (string, error)            //Get specified device's token
-	SaveDeviceTokenByKey(key, token string) (string, error) //Create or update specified devices's token
-	DeleteDeviceByKey(key string) error                     //Delete specified device
-	Close() error                                           //Close the database
+	CountAll() (int, error)                                          //Get db records count
+	DeviceByKey(key string) (*Device, error)                         //Get specified device
+	StoredDevice(key string) (*Device, error)                        //Get specified device record, even without a valid token
+	SaveDevice(key string, device *Device) (string, error)           //Create or update specified device
+	UpdateDevice(key string, update func(device *Device) bool) error //Update specified device in one step, kept when update returns false
+	DeleteDeviceByKey(key string) error                              //Delete specified device
+	Close() error                                                    //Close the database
 }
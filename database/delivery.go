@@ -0,0 +1,25 @@
+package database
+
+import "time"
+
+// Delivery is a push answered by APNs
+type Delivery struct {
+	// Message id of the push, the apns-id unless the push was given an id
+	ID        string `json:"id"`
+	DeviceKey string `json:"device_key"`
+	// apns-id of the notification, apns-unique-id in the development environment only
+	ApnsID       string `json:"apns_id"`
+	ApnsUniqueID string `json:"apns_unique_id,omitempty"`
+	StatusCode   int    `json:"status_code"`
+	Reason       string `json:"reason,omitempty"`
+	Retries      int    `json:"retries"`
+	// Unix time of the delivery
+	CreatedAt int64 `json:"created_at"`
+}
+
+// DeliveryLog is implemented by the databases keeping a log of the deliveries
+type DeliveryLog interface {
+	SaveDelivery(delivery *Delivery) error         //Append the delivery to the log
+	DeliveriesByID(id string) ([]*Delivery, error) //Get the deliveries of the message id
+	PruneDeliveries(before time.Time) error        //Delete the deliveries older than the time
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 )
@@ -16,20 +17,55 @@ func (d *EnvBase) CountAll() (int, error) {
 	return 1, nil
 }
 
-func (d *EnvBase) DeviceTokenByKey(key string) (string, error) {
+func (d *EnvBase) DeviceByKey(key string) (*Device, error) {
 	if key == os.Getenv("BARK_KEY") {
-		return os.Getenv("BARK_DEVICE_TOKEN"), nil
+		device := &Device{
+			Token:       os.Getenv("BARK_DEVICE_TOKEN"),
+			Platform:    os.Getenv("BARK_DEVICE_PLATFORM"),
+			Environment: os.Getenv("BARK_DEVICE_ENVIRONMENT"),
+			Profile:     os.Getenv("BARK_DEVICE_PROFILE"),
+
+			ActivityToken:      os.Getenv("BARK_DEVICE_ACTIVITY_TOKEN"),
+			ActivityStartToken: os.Getenv("BARK_DEVICE_ACTIVITY_START_TOKEN"),
+
+			WebPushP256dh: os.Getenv("BARK_DEVICE_WEBPUSH_P256DH"),
+			WebPushAuth:   os.Getenv("BARK_DEVICE_WEBPUSH_AUTH"),
+
+			FallbackEmail:  os.Getenv("BARK_DEVICE_FALLBACK_EMAIL"),
+			ReceiverSecret: os.Getenv("BARK_DEVICE_RECEIVER_SECRET"),
+		}
+		// JSON webhook target of the webhook platform
+		if target := os.Getenv("BARK_DEVICE_WEBHOOK"); target != "" {
+			device.Webhook = &WebhookTarget{}
+			if err := json.Unmarshal([]byte(target), device.Webhook); err != nil {
+				return nil, fmt.Errorf("invalid BARK_DEVICE_WEBHOOK: %v", err)
+			}
+		}
+		return device, nil
 	}
-	return "nil", fmt.Errorf("key not found")
+	return nil, fmt.Errorf("key not found")
+}
+
+// StoredDevice returns the device of the environment variables, they have no separate record
+func (d *EnvBase) StoredDevice(key string) (*Device, error) {
+	return d.DeviceByKey(key)
 }
 
-func (d *EnvBase) SaveDeviceTokenByKey(key, token string) (string, error) {
-	if token == os.Getenv("BARK_DEVICE_TOKEN") {
+func (d *EnvBase) SaveDevice(key string, device *Device) (string, error) {
+	if device.Token == os.Getenv("BARK_DEVICE_TOKEN") {
 		return os.Getenv("BARK_KEY"), nil
 	}
 	return "nil", fmt.Errorf("device token is invalid")
 }
 
+// UpdateDevice keeps the device of the environment variables, they can't be changed
+func (d *EnvBase) UpdateDevice(key string, update func(device *Device) bool) error {
+	if key != os.Getenv("BARK_KEY") {
+		return fmt.Errorf("key not found")
+	}
+	return nil
+}
+
 func (d *EnvBase) DeleteDeviceByKey(key string) error {
 	return fmt.Errorf("not supported")
 }
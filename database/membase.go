@@ -3,13 +3,25 @@ package database
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	cacheKey         = "MemoryBaseKey"
-	cacheDeviceToken = ""
+	cacheKey    = "MemoryBaseKey"
+	cacheDevice = Device{}
+	// Pushes save the device too, concurrently with the registrations
+	cacheLock sync.RWMutex
 )
 
+// Number of the most recent deliveries kept in memory
+const memDeliveryLogSize = 1000
+
+var deliveryLog = struct {
+	sync.Mutex
+	deliveries []Delivery
+}{}
+
 type MemBase struct {
 }
 
@@ -21,30 +33,147 @@ func (d *MemBase) CountAll() (int, error) {
 	return 1, nil
 }
 
-func (d *MemBase) DeviceTokenByKey(key string) (string, error) {
-	if cacheKey == key && cacheDeviceToken != "" {
-		return cacheDeviceToken, nil
+func (d *MemBase) DeviceByKey(key string) (*Device, error) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	if cacheKey == key && cacheDevice.Token != "" {
+		device := cacheDevice
+		return &device, nil
+	}
+	return nil, fmt.Errorf("key not found")
+}
+
+func (d *MemBase) StoredDevice(key string) (*Device, error) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	if cacheKey == key {
+		device := cacheDevice
+		return &device, nil
 	}
-	return "nil", fmt.Errorf("key not found")
+	return nil, fmt.Errorf("key not found")
 }
 
-func (d *MemBase) SaveDeviceTokenByKey(key, token string) (string, error) {
+func (d *MemBase) SaveDevice(key string, device *Device) (string, error) {
 	if key != "" && key != cacheKey {
 		return "", fmt.Errorf("key not found")
 	}
-	// Deep copy prevents Fiber memory overwrite bugs.
-	cacheDeviceToken = strings.Clone(token)
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	cacheDevice = cloneDevice(device)
 	return key, nil
 }
 
+// UpdateDevice updates the device under the lock, so no save happens in between
+func (d *MemBase) UpdateDevice(key string, update func(device *Device) bool) error {
+	if key != cacheKey {
+		return fmt.Errorf("key not found")
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	device := cacheDevice
+	if update(&device) {
+		cacheDevice = cloneDevice(&device)
+	}
+	return nil
+}
+
 func (d *MemBase) DeleteDeviceByKey(key string) error {
 	if key != "" && key != cacheKey {
 		return fmt.Errorf("key not found")
 	}
-	cacheDeviceToken = ""
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	cacheDevice = Device{}
 	return nil
 }
 
 func (d *MemBase) Close() error {
 	return nil
 }
+
+func (d *MemBase) SaveDelivery(delivery *Delivery) error {
+	deliveryLog.Lock()
+	defer deliveryLog.Unlock()
+	if len(deliveryLog.deliveries) >= memDeliveryLogSize {
+		deliveryLog.deliveries = deliveryLog.deliveries[1:]
+	}
+	// Deep copy prevents Fiber memory overwrite bugs.
+	deliveryLog.deliveries = append(deliveryLog.deliveries, Delivery{
+		ID:           strings.Clone(delivery.ID),
+		DeviceKey:    strings.Clone(delivery.DeviceKey),
+		ApnsID:       strings.Clone(delivery.ApnsID),
+		ApnsUniqueID: strings.Clone(delivery.ApnsUniqueID),
+		StatusCode:   delivery.StatusCode,
+		Reason:       strings.Clone(delivery.Reason),
+		Retries:      delivery.Retries,
+		CreatedAt:    delivery.CreatedAt,
+	})
+	return nil
+}
+
+func (d *MemBase) DeliveriesByID(id string) ([]*Delivery, error) {
+	deliveryLog.Lock()
+	defer deliveryLog.Unlock()
+	var deliveries []*Delivery
+	for _, delivery := range deliveryLog.deliveries {
+		if delivery.ID == id {
+			delivery := delivery
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (d *MemBase) PruneDeliveries(before time.Time) error {
+	deliveryLog.Lock()
+	defer deliveryLog.Unlock()
+	i := 0
+	for i < len(deliveryLog.deliveries) && deliveryLog.deliveries[i].CreatedAt < before.Unix() {
+		i++
+	}
+	deliveryLog.deliveries = deliveryLog.deliveries[i:]
+	return nil
+}
+
+// cloneDevice deep copies a device, this prevents Fiber memory overwrite bugs
+func cloneDevice(device *Device) Device {
+	return Device{
+		Token:       strings.Clone(device.Token),
+		Platform:    strings.Clone(device.Platform),
+		Environment: strings.Clone(device.Environment),
+		Profile:     strings.Clone(device.Profile),
+
+		ActivityToken:      strings.Clone(device.ActivityToken),
+		ActivityStartToken: strings.Clone(device.ActivityStartToken),
+
+		WebPushP256dh:  strings.Clone(device.WebPushP256dh),
+		WebPushAuth:    strings.Clone(device.WebPushAuth),
+		Webhook:        cloneWebhook(device.Webhook),
+		FallbackEmail:  strings.Clone(device.FallbackEmail),
+		ReceiverSecret: strings.Clone(device.ReceiverSecret),
+
+		RegisteredAt:  device.RegisteredAt,
+		InvalidatedAt: device.InvalidatedAt,
+		InvalidReason: strings.Clone(device.InvalidReason),
+		DeliveredAt:   device.DeliveredAt,
+	}
+}
+
+func cloneWebhook(target *WebhookTarget) *WebhookTarget {
+	if target == nil {
+		return nil
+	}
+	clone := &WebhookTarget{
+		URL:          strings.Clone(target.URL),
+		Method:       strings.Clone(target.Method),
+		BodyTemplate: strings.Clone(target.BodyTemplate),
+		Secret:       strings.Clone(target.Secret),
+	}
+	if target.Headers != nil {
+		clone.Headers = make(map[string]string, len(target.Headers))
+		for k, v := range target.Headers {
+			clone.Headers[strings.Clone(k)] = strings.Clone(v)
+		}
+	}
+	return clone
+}
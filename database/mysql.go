@@ -4,8 +4,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql"
@@ -14,6 +17,9 @@ import (
 )
 
 type MySQL struct {
+	// TLS material of the connections, reloaded by Reload
+	tlsName, caPath, certPath, keyPath string
+	tlsSkipVerify                      bool
 }
 
 var mysqlDB *sql.DB
@@ -27,17 +33,69 @@ const (
 		"    PRIMARY KEY (`id`)," +
 		"    UNIQUE KEY `key` (`key`)" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	// The deliveries table always exists, it stays empty when the delivery log is disabled
+	deliverySchema = "" +
+		"CREATE TABLE IF NOT EXISTS `deliveries` (" +
+		"    `seq` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT," +
+		"    `id` VARCHAR(255) NOT NULL," +
+		"    `device_key` VARCHAR(255) NOT NULL," +
+		"    `apns_id` VARCHAR(64) NOT NULL," +
+		"    `apns_unique_id` VARCHAR(64) NOT NULL DEFAULT ''," +
+		"    `status_code` INT NOT NULL," +
+		"    `reason` VARCHAR(64) NOT NULL DEFAULT ''," +
+		"    `retries` INT NOT NULL DEFAULT 0," +
+		"    `created_at` BIGINT NOT NULL," +
+		"    PRIMARY KEY (`seq`)," +
+		"    KEY `id` (`id`)," +
+		"    KEY `created_at` (`created_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	// MySQL error number of "Duplicate column name"
+	errDupFieldName = 1060
 )
 
+// Columns added after the initial schema, existing tables are migrated at startup
+var dbMigrations = []string{
+	"ALTER TABLE `devices` ADD COLUMN `environment` VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `profile` VARCHAR(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `activity_token` VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `activity_start_token` VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `registered_at` BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `devices` ADD COLUMN `invalidated_at` BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `devices` ADD COLUMN `invalid_reason` VARCHAR(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `platform` VARCHAR(16) NOT NULL DEFAULT ''",
+	// Web Push subscription endpoints are longer than device tokens
+	"ALTER TABLE `devices` MODIFY COLUMN `token` VARCHAR(1024) NOT NULL",
+	"ALTER TABLE `devices` ADD COLUMN `webpush_p256dh` VARCHAR(128) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `webpush_auth` VARCHAR(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `webhook` TEXT NULL",
+	"ALTER TABLE `devices` ADD COLUMN `fallback_email` VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `receiver_secret` VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `devices` ADD COLUMN `delivered_at` BIGINT NOT NULL DEFAULT 0",
+}
+
 func NewMySQL(dsn string) Database {
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		logger.Fatalf("failed to open database connection (%s): %v", dsn, err)
 	}
 
-	_, err = db.Exec(dbSchema)
-	if err != nil {
-		logger.Fatalf("failed to init database schema(%s): %v", dbSchema, err)
+	for _, schema := range []string{dbSchema, deliverySchema} {
+		_, err = db.Exec(schema)
+		if err != nil {
+			logger.Fatalf("failed to init database schema(%s): %v", schema, err)
+		}
+	}
+
+	for _, migration := range dbMigrations {
+		_, err = db.Exec(migration)
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == errDupFieldName {
+			continue
+		}
+		if err != nil {
+			logger.Fatalf("failed to migrate database schema(%s): %v", migration, err)
+		}
 	}
 
 	mysqlDB = db
@@ -50,20 +108,41 @@ func NewMySQLWithTLS(dsn, tlsName, caPath, certPath, keyPath string, isSkipVerif
 	logger.Infof("MySQL TLS client cert: %v", certPath)
 	logger.Infof("MySQL TLS client key: %v", keyPath)
 	logger.Infof("Server certificate verification skipped: %v", isSkipVerify)
+	if err := registerTLSConfig(tlsName, caPath, certPath, keyPath, isSkipVerify); err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	// 2. Append TLS parameter to DSN if missing
+	if !strings.Contains(dsn, "tls=") {
+		if strings.Contains(dsn, "?") {
+			dsn = dsn + "&tls=" + tlsName
+		} else {
+			dsn = dsn + "?tls=" + tlsName
+		}
+	}
+
+	// 3. Create and return the Database instance
+	db := NewMySQL(dsn).(*MySQL)
+	db.tlsName, db.caPath, db.certPath, db.keyPath, db.tlsSkipVerify = tlsName, caPath, certPath, keyPath, isSkipVerify
+	return db
+}
+
+// registerTLSConfig loads the TLS material and registers it to the MySQL driver
+func registerTLSConfig(tlsName, caPath, certPath, keyPath string, isSkipVerify bool) error {
 	rootCertPool := x509.NewCertPool()
 	pem, err := os.ReadFile(caPath)
 	if err != nil {
-		logger.Fatalf("failed to read CA cert: %v", err)
+		return fmt.Errorf("failed to read CA cert: %v", err)
 	}
 	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-		logger.Fatalf("failed to append CA cert")
+		return fmt.Errorf("failed to append CA cert")
 	}
 
 	var certs []tls.Certificate
 	if certPath != "" && keyPath != "" {
 		clientCert, err := tls.LoadX509KeyPair(certPath, keyPath)
 		if err != nil {
-			logger.Fatalf("failed to load client cert and key: %v", err)
+			return fmt.Errorf("failed to load client cert and key: %v", err)
 		}
 		certs = []tls.Certificate{clientCert}
 	}
@@ -75,20 +154,22 @@ func NewMySQLWithTLS(dsn, tlsName, caPath, certPath, keyPath string, isSkipVerif
 	}
 
 	if err := mysql.RegisterTLSConfig(tlsName, tlsConfig); err != nil {
-		logger.Fatalf("failed to register TLS config: %v", err)
+		return fmt.Errorf("failed to register TLS config: %v", err)
 	}
+	return nil
+}
 
-	// 2. Append TLS parameter to DSN if missing
-	if !strings.Contains(dsn, "tls=") {
-		if strings.Contains(dsn, "?") {
-			dsn = dsn + "&tls=" + tlsName
-		} else {
-			dsn = dsn + "?tls=" + tlsName
-		}
+// Reload reloads the TLS material from its files, new connections use the
+// reloaded material while the established ones are kept
+func (d *MySQL) Reload() error {
+	if d.tlsName == "" {
+		return nil
 	}
-
-	// 3. Create and return the Database instance
-	return NewMySQL(dsn)
+	if err := registerTLSConfig(d.tlsName, d.caPath, d.certPath, d.keyPath, d.tlsSkipVerify); err != nil {
+		return err
+	}
+	logger.Infof("MySQL TLS material reloaded")
+	return nil
 }
 
 func (d *MySQL) CountAll() (int, error) {
@@ -101,28 +182,98 @@ func (d *MySQL) CountAll() (int, error) {
 	return count, nil
 }
 
-func (d *MySQL) DeviceTokenByKey(key string) (string, error) {
-	var token string
-	err := mysqlDB.QueryRow("SELECT `token` FROM `devices` WHERE `key`=? ", key).Scan(&token)
+// mysqlConn runs the device queries on the connection pool or in a transaction
+type mysqlConn interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (d *MySQL) DeviceByKey(key string) (*Device, error) {
+	return selectDevice(mysqlDB, key, "")
+}
+
+// selectDevice reads the device of the key, lock is appended to the query, such as FOR UPDATE
+func selectDevice(conn mysqlConn, key, lock string) (*Device, error) {
+	var device Device
+	var target sql.NullString
+	err := conn.QueryRow("SELECT `token`,`environment`,`profile`,`activity_token`,`activity_start_token`,"+
+		"`registered_at`,`invalidated_at`,`invalid_reason`,`platform`,"+
+		"`webpush_p256dh`,`webpush_auth`,`webhook`,`fallback_email`,`receiver_secret`,`delivered_at` FROM `devices` WHERE `key`=? "+lock, key).
+		Scan(&device.Token, &device.Environment, &device.Profile, &device.ActivityToken, &device.ActivityStartToken,
+			&device.RegisteredAt, &device.InvalidatedAt, &device.InvalidReason, &device.Platform,
+			&device.WebPushP256dh, &device.WebPushAuth, &target, &device.FallbackEmail, &device.ReceiverSecret, &device.DeliveredAt)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if target.Valid && target.String != "" {
+		device.Webhook = &WebhookTarget{}
+		if err := json.Unmarshal([]byte(target.String), device.Webhook); err != nil {
+			return nil, fmt.Errorf("invalid webhook target: %v", err)
+		}
 	}
 
-	return token, nil
+	return &device, nil
+}
+
+// StoredDevice returns the device record of the key, the token is not validated by DeviceByKey either
+func (d *MySQL) StoredDevice(key string) (*Device, error) {
+	return d.DeviceByKey(key)
 }
 
-func (d *MySQL) SaveDeviceTokenByKey(key, token string) (string, error) {
+func (d *MySQL) SaveDevice(key string, device *Device) (string, error) {
 	if key == "" {
 		// Generate a new UUID as the deviceKey when a new device register
 		key = shortuuid.New()
 	}
+	if err := saveDevice(mysqlDB, key, device); err != nil {
+		return "", err
+	}
+	return key, nil
+}
 
-	_, err := mysqlDB.Exec("INSERT INTO `devices` (`key`,`token`) VALUES (?,?) ON DUPLICATE KEY UPDATE `token`=?", key, token, token)
+// UpdateDevice updates the device in a transaction holding the lock of its row
+func (d *MySQL) UpdateDevice(key string, update func(device *Device) bool) error {
+	tx, err := mysqlDB.Begin()
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	return key, nil
+	device, err := selectDevice(tx, key, "FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	if !update(device) {
+		return nil
+	}
+	if err := saveDevice(tx, key, device); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func saveDevice(conn mysqlConn, key string, device *Device) error {
+	var target sql.NullString
+	if device.Webhook != nil {
+		bs, err := json.Marshal(device.Webhook)
+		if err != nil {
+			return err
+		}
+		target = sql.NullString{String: string(bs), Valid: true}
+	}
+
+	_, err := conn.Exec("INSERT INTO `devices` (`key`,`token`,`environment`,`profile`,`activity_token`,`activity_start_token`,"+
+		"`registered_at`,`invalidated_at`,`invalid_reason`,`platform`,`webpush_p256dh`,`webpush_auth`,`webhook`,`fallback_email`,`receiver_secret`,`delivered_at`) "+
+		"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE `token`=VALUES(`token`),`environment`=VALUES(`environment`),`profile`=VALUES(`profile`),"+
+		"`activity_token`=VALUES(`activity_token`),`activity_start_token`=VALUES(`activity_start_token`),"+
+		"`registered_at`=VALUES(`registered_at`),`invalidated_at`=VALUES(`invalidated_at`),`invalid_reason`=VALUES(`invalid_reason`),"+
+		"`platform`=VALUES(`platform`),`webpush_p256dh`=VALUES(`webpush_p256dh`),`webpush_auth`=VALUES(`webpush_auth`),"+
+		"`webhook`=VALUES(`webhook`),`fallback_email`=VALUES(`fallback_email`),`receiver_secret`=VALUES(`receiver_secret`),`delivered_at`=VALUES(`delivered_at`)",
+		key, device.Token, device.Environment, device.Profile, device.ActivityToken, device.ActivityStartToken,
+		device.RegisteredAt, device.InvalidatedAt, device.InvalidReason, device.Platform,
+		device.WebPushP256dh, device.WebPushAuth, target, device.FallbackEmail, device.ReceiverSecret, device.DeliveredAt)
+	return err
 }
 
 func (d *MySQL) DeleteDeviceByKey(key string) error {
@@ -133,3 +284,37 @@ func (d *MySQL) DeleteDeviceByKey(key string) error {
 func (d *MySQL) Close() error {
 	return mysqlDB.Close()
 }
+
+func (d *MySQL) SaveDelivery(delivery *Delivery) error {
+	_, err := mysqlDB.Exec("INSERT INTO `deliveries` (`id`,`device_key`,`apns_id`,`apns_unique_id`,`status_code`,`reason`,`retries`,`created_at`) "+
+		"VALUES (?,?,?,?,?,?,?,?)",
+		delivery.ID, delivery.DeviceKey, delivery.ApnsID, delivery.ApnsUniqueID, delivery.StatusCode, delivery.Reason,
+		delivery.Retries, delivery.CreatedAt)
+	return err
+}
+
+func (d *MySQL) DeliveriesByID(id string) ([]*Delivery, error) {
+	rows, err := mysqlDB.Query("SELECT `id`,`device_key`,`apns_id`,`apns_unique_id`,`status_code`,`reason`,`retries`,`created_at` "+
+		"FROM `deliveries` WHERE `id`=? ORDER BY `seq`", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		var delivery Delivery
+		err := rows.Scan(&delivery.ID, &delivery.DeviceKey, &delivery.ApnsID, &delivery.ApnsUniqueID, &delivery.StatusCode,
+			&delivery.Reason, &delivery.Retries, &delivery.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (d *MySQL) PruneDeliveries(before time.Time) error {
+	_, err := mysqlDB.Exec("DELETE FROM `deliveries` WHERE `created_at`<?", before.Unix())
+	return err
+}
@@ -0,0 +1,198 @@
+// Package email sends plain-text and HTML emails through an SMTP server.
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection security of the SMTP server
+const (
+	// TLSStartTLS upgrades the connection with STARTTLS, the server must support it
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS, usually on port 465
+	TLSImplicit = "tls"
+	// TLSNone sends in plain text, authentication is only allowed to localhost
+	TLSNone = "none"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	sendTimeout = 30 * time.Second
+)
+
+// Config is the SMTP server the emails are sent through
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Sender address, such as "Bark <bark@example.com>"
+	From string
+	// TLSStartTLS (default), TLSImplicit or TLSNone
+	TLS string
+}
+
+// Message is an email with alternative plain-text and HTML bodies
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Sender sends the emails with the configured server
+type Sender struct {
+	cfg  Config
+	from *mail.Address
+}
+
+func NewSender(cfg Config) (*Sender, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("smtp host is empty")
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid smtp port: %d", cfg.Port)
+	}
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = TLSStartTLS
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return nil, fmt.Errorf("invalid smtp tls mode: %s, must be starttls, tls or none", cfg.TLS)
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp sender address: %v", err)
+	}
+	return &Sender{cfg: cfg, from: from}, nil
+}
+
+// ValidateAddress checks an email address is a single bare address
+func ValidateAddress(address string) error {
+	addr, err := mail.ParseAddress(address)
+	if err != nil || addr.Address != address {
+		return fmt.Errorf("invalid email address: %s", address)
+	}
+	return nil
+}
+
+// Send sends the message in a new SMTP session
+func (s *Sender) Send(msg *Message) error {
+	if err := ValidateAddress(msg.To); err != nil {
+		return err
+	}
+	body, err := msg.bytes(s.from, time.Now())
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(sendTimeout))
+	if s.cfg.TLS == TLSImplicit {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.cfg.Host})
+	}
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %v", err)
+	}
+	defer client.Close()
+
+	if s.cfg.TLS == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp: the server does not support STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: s.cfg.Host}); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+	if s.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: %v", err)
+	}
+	return client.Quit()
+}
+
+// bytes encodes the message as a multipart/alternative MIME message
+func (m *Message) bytes(from *mail.Address, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	header := []string{
+		"From: " + from.String(),
+		"To: " + m.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + date.Format(time.RFC1123Z),
+		"Message-ID: <" + hex.EncodeToString(id) + "@" + domain + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + mw.Boundary(),
+	}
+	buf.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		if part.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
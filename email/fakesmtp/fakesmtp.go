@@ -0,0 +1,158 @@
+// Package fakesmtp implements a fake SMTP server, it records the received emails instead of
+// delivering them and can be scripted to reject them, so the email path can be tested offline.
+package fakesmtp
+
+import (
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Mail is an email received by the fake server
+type Mail struct {
+	From string
+	To   []string
+	// Username of the AUTH PLAIN authentication, empty when the client did not authenticate
+	Username string
+	Data     string
+}
+
+// Message parses the received email
+func (m *Mail) Message() (*mail.Message, error) {
+	return mail.ReadMessage(strings.NewReader(m.Data))
+}
+
+// Server is a fake SMTP server
+type Server struct {
+	mu     sync.Mutex
+	mails  []Mail
+	reject string
+}
+
+func New() *Server {
+	return &Server{}
+}
+
+// Reject makes the server reject the recipients with the SMTP reply, such as
+// "550 mailbox unavailable", an empty reply accepts them again
+func (s *Server) Reject(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reply
+}
+
+// Mails returns the emails received so far
+func (s *Server) Mails() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail(nil), s.mails...)
+}
+
+// Reset clears the received emails and the scripted rejection
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mails = nil
+	s.reject = ""
+}
+
+// Serve accepts the SMTP sessions until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *Server) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return tp.PrintfLine(format, args...) == nil
+	}
+
+	var m Mail
+	reply("220 fakesmtp ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-fakesmtp")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN")
+		case "HELO":
+			reply("250 fakesmtp")
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mechanism, "PLAIN") {
+				reply("504 unsupported authentication mechanism")
+				continue
+			}
+			creds, err := base64.StdEncoding.DecodeString(initial)
+			parts := strings.Split(string(creds), "\x00")
+			if err != nil || len(parts) != 3 {
+				reply("501 invalid credentials")
+				continue
+			}
+			m.Username = parts[1]
+			reply("235 authenticated")
+		case "MAIL":
+			m.From = address(arg)
+			m.To = nil
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject != "" {
+				reply("%s", reject)
+				continue
+			}
+			m.To = append(m.To, address(arg))
+			reply("250 ok")
+		case "DATA":
+			if m.From == "" || len(m.To) == 0 {
+				reply("503 bad sequence of commands")
+				continue
+			}
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			m.Data = strings.Join(lines, "\r\n")
+			s.mu.Lock()
+			s.mails = append(s.mails, m)
+			s.mu.Unlock()
+			m = Mail{Username: m.Username}
+			reply("250 queued")
+		case "RSET":
+			m = Mail{Username: m.Username}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// address extracts the address of "FROM:<address>" and "TO:<address>"
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/finb/bark-server/v2/apns/fakeapns"
+	"github.com/mritd/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// fakeAPNsCommand runs a fake APNs gateway for offline testing,
+// start the server with --apns-host http://<addr> to push to it
+func fakeAPNsCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "fake-apns",
+		Usage: "Run a fake APNs server which records the received notifications",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "addr",
+				Usage: "Fake APNs server listen address",
+				Value: "127.0.0.1:2197",
+			},
+			&cli.StringSliceFlag{
+				Name:  "respond",
+				Usage: "Scripted response of a device token (* for any) in the form of TOKEN=STATUS[:REASON] or TOKEN=drop, e.g. *=410:Unregistered",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			srv := fakeapns.New()
+			for _, item := range c.StringSlice("respond") {
+				deviceToken, status, ok := strings.Cut(item, "=")
+				if !ok {
+					return cli.Exit("invalid scripted response: "+item, 1)
+				}
+				resp, err := fakeapns.ParseResponse(status)
+				if err != nil {
+					return err
+				}
+				srv.Respond(deviceToken, resp)
+			}
+
+			addr := c.String("addr")
+			logger.Infof("Fake APNs Server Listen at: %s, received notifications: http://%s/notifications", addr, addr)
+			return srv.ListenAndServe(addr)
+		},
+	}
+}
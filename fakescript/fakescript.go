@@ -0,0 +1,64 @@
+// Package fakescript holds the scripted responses of the fake push services, the responses
+// queued for a device are returned once each, then the response fixed for it is returned.
+package fakescript
+
+import "sync"
+
+// AnyDevice scripts the responses of every device without its own script
+const AnyDevice = "*"
+
+// Script holds the scripted responses by device, the zero value has none
+type Script[R any] struct {
+	mu sync.Mutex
+	// one-shot responses by device
+	queued map[string][]R
+	// persistent responses by device
+	fixed map[string]R
+}
+
+// Queue queues responses returned once each to the following requests of the device
+func (s *Script[R]) Queue(device string, responses ...R) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued == nil {
+		s.queued = make(map[string][]R)
+	}
+	s.queued[device] = append(s.queued[device], responses...)
+}
+
+// Fix makes every request of the device return the response once the queued ones are used up
+func (s *Script[R]) Fix(device string, response R) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fixed == nil {
+		s.fixed = make(map[string]R)
+	}
+	s.fixed[device] = response
+}
+
+// Next pops the response of a request of the device, the responses of AnyDevice
+// are used when the device has none, ok is false when neither is scripted
+func (s *Script[R]) Next(device string) (response R, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range []string{device, AnyDevice} {
+		if queue := s.queued[d]; len(queue) > 0 {
+			s.queued[d] = queue[1:]
+			return queue[0], true
+		}
+	}
+	for _, d := range []string{device, AnyDevice} {
+		if response, ok := s.fixed[d]; ok {
+			return response, true
+		}
+	}
+	return response, false
+}
+
+// Reset clears all scripted responses
+func (s *Script[R]) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = nil
+	s.fixed = nil
+}
@@ -0,0 +1,27 @@
+package fakescript
+
+import "testing"
+
+func TestScript(t *testing.T) {
+	var s Script[int]
+	if _, ok := s.Next("a"); ok {
+		t.Fatal("unexpected response of an empty script")
+	}
+
+	s.Queue("a", 1, 2)
+	s.Fix("a", 3)
+	s.Fix(AnyDevice, 4)
+	for _, want := range []int{1, 2, 3, 3} {
+		if got, ok := s.Next("a"); !ok || got != want {
+			t.Fatalf("want %d, got %d", want, got)
+		}
+	}
+	if got, ok := s.Next("b"); !ok || got != 4 {
+		t.Fatalf("want the response of any device, got %d", got)
+	}
+
+	s.Reset()
+	if _, ok := s.Next("a"); ok {
+		t.Fatal("the script was not reset")
+	}
+}
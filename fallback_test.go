@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/finb/bark-server/v2/apns/fakeapns"
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/email"
+	"github.com/finb/bark-server/v2/email/fakesmtp"
+)
+
+// startFakeSMTP enables the fallback emails with a fake SMTP server
+func startFakeSMTP(t *testing.T) *fakesmtp.Server {
+	fakeSMTP := fakesmtp.New()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go fakeSMTP.Serve(l)
+
+	sender, err := email.NewSender(email.Config{
+		Host:     "127.0.0.1",
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		Username: "bark",
+		Password: "password",
+		From:     "Bark <bark@example.com>",
+		TLS:      email.TLSNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFake(t, setEmailSender, sender)
+	return fakeSMTP
+}
+
+// mailParts returns the bodies of the parts of a multipart email by content type
+func mailParts(t *testing.T, m fakesmtp.Mail) (string, map[string]string) {
+	msg, err := m.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[mediaType] = strings.ReplaceAll(string(body), "\r\n", "\n")
+	}
+	return subject, parts
+}
+
+func TestEmailFallback(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	fakeSMTP := startFakeSMTP(t)
+	fakeAPNs.Respond(deviceToken, fakeapns.Response{StatusCode: 410, Reason: "Unregistered"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Fallback email without basic auth",
+			Method:         "POST",
+			URL:            "/fallback-email/register",
+			Body:           `{"device_key":"` + key + `","email":"me@example.com"}`,
+			IsJson:         true,
+			WantStatusCode: 403,
+		},
+	})
+
+	basicAuthEnabled = true
+	t.Cleanup(func() { basicAuthEnabled = false })
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Invalid fallback email",
+			Method:         "POST",
+			URL:            "/fallback-email/register",
+			Body:           `{"device_key":"` + key + `","email":"Me <me@example.com>"}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Push without fallback email",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Register fallback email",
+			Method:         "POST",
+			URL:            "/fallback-email/register",
+			Body:           `{"device_key":"` + key + `","email":"me@example.com"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalidated token falls back to email",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","title":"Disk <full>","body":"92% used","group":"ops","url":"https://day.app"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"fallback":{"channel":"email","reason":"device token was invalidated by its push service`,
+		},
+		{
+			Name:           "Silent pushes don't fall back",
+			Method:         "GET",
+			URL:            "/" + key + "?silent=1",
+			WantStatusCode: 400,
+		},
+	})
+
+	mails := fakeSMTP.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("want 1 email, got %d", len(mails))
+	}
+	if m := mails[0]; m.From != "bark@example.com" || len(m.To) != 1 || m.To[0] != "me@example.com" || m.Username != "bark" {
+		t.Fatalf("unexpected email envelope: %+v", m)
+	}
+	subject, parts := mailParts(t, mails[0])
+	if subject != "[ops] Disk <full>" || parts["text/plain"] != "Disk <full>\n\n92% used\n\nhttps://day.app\n" ||
+		!strings.Contains(parts["text/html"], "<h3>Disk &lt;full&gt;</h3>") || !strings.Contains(parts["text/html"], `<a href="https://day.app">`) {
+		t.Fatalf("unexpected email: %s %+v", subject, parts)
+	}
+
+	// The fallback email is kept when the device registers again, a token rejected
+	// as bad before any delivery doesn't fall back
+	fakeAPNs.Reset()
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 400, Reason: "BadDeviceToken"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Register again",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           `{"device_key":"` + key + `","device_token":"` + deviceToken + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Bad token never delivered to",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+			WantBody:       `"message":"push failed: BadDeviceToken"`,
+		},
+	})
+	if len(fakeSMTP.Mails()) != 1 {
+		t.Fatalf("want no fallback email for a bad token, got %d emails", len(fakeSMTP.Mails()))
+	}
+
+	fakeAPNs.Reset()
+	fakeSMTP.Reject("550 mailbox unavailable")
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Register again",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           `{"device_key":"` + key + `","device_token":"` + deviceToken + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Delivered push",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 200,
+		},
+	})
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 400, Reason: "BadDeviceToken"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Failed fallback email",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+			WantBody:       `"sent":false,"error":"smtp: 550`,
+		},
+	})
+	if device, _ := db.DeviceByKey(key); device.FallbackEmail != "me@example.com" {
+		t.Fatalf("the fallback email was not kept: %+v", device)
+	}
+}
@@ -0,0 +1,155 @@
+// Package fakefcm implements a fake FCM HTTP v1 API and OAuth2 token endpoint, it records
+// the received messages and can be scripted to reject them, so the Android push path can be tested offline.
+package fakefcm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/finb/bark-server/v2/fakescript"
+	"github.com/finb/bark-server/v2/fcm"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+// TokenPath is the OAuth2 token endpoint, the token_uri of the test credentials
+const TokenPath = "/token"
+
+// AccessToken is the access token issued by the fake token endpoint
+const AccessToken = "fake-fcm-access-token"
+
+// AnyDevice scripts the responses of every registration token without its own script
+const AnyDevice = fakescript.AnyDevice
+
+// Message is a message received by the fake API
+type Message struct {
+	ProjectID     string      `json:"project_id"`
+	Authorization string      `json:"authorization"`
+	Message       fcm.Message `json:"message"`
+}
+
+// Response is a scripted API response
+type Response struct {
+	StatusCode int
+	// Canonical status, such as NOT_FOUND
+	Status string
+	// FCM error code, such as UNREGISTERED
+	ErrorCode string
+}
+
+// Server is a fake FCM API
+type Server struct {
+	mu        sync.Mutex
+	messages  []Message
+	responses fakescript.Script[Response]
+}
+
+func New() *Server {
+	return &Server{}
+}
+
+// Script queues responses returned once each to the following messages of the registration token
+func (s *Server) Script(token string, responses ...Response) {
+	s.responses.Queue(token, responses...)
+}
+
+// Respond makes every message of the registration token return the response once the scripted ones are used up
+func (s *Server) Respond(token string, response Response) {
+	s.responses.Fix(token, response)
+}
+
+// Messages returns the messages received so far
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Reset clears the received messages and all scripted responses
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	s.responses.Reset()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == TokenPath && r.Method == http.MethodPost:
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.FormValue("assertion") == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": AccessToken,
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/projects/") && strings.HasSuffix(r.URL.Path, "/messages:send") && r.Method == http.MethodPost:
+		s.handleSend(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	projectID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/"), "/messages:send")
+	if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+		writeError(w, Response{StatusCode: http.StatusUnauthorized, Status: "UNAUTHENTICATED"})
+		return
+	}
+	var req struct {
+		Message fcm.Message `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message.Token == "" {
+		writeError(w, Response{StatusCode: http.StatusBadRequest, Status: "INVALID_ARGUMENT", ErrorCode: "INVALID_ARGUMENT"})
+		return
+	}
+
+	s.mu.Lock()
+	s.messages = append(s.messages, Message{
+		ProjectID:     projectID,
+		Authorization: r.Header.Get("Authorization"),
+		Message:       req.Message,
+	})
+	resp := s.nextResponse(req.Message.Token)
+	s.mu.Unlock()
+
+	if resp.StatusCode == http.StatusOK {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"name": "projects/" + projectID + "/messages/" + shortuuid.New(),
+		})
+		return
+	}
+	writeError(w, resp)
+}
+
+// nextResponse pops the scripted response of the registration token, the messages succeed without one
+func (s *Server) nextResponse(token string) Response {
+	if resp, ok := s.responses.Next(token); ok {
+		return resp
+	}
+	return Response{StatusCode: http.StatusOK}
+}
+
+func writeError(w http.ResponseWriter, resp Response) {
+	body := map[string]interface{}{
+		"code":    resp.StatusCode,
+		"message": http.StatusText(resp.StatusCode),
+		"status":  resp.Status,
+	}
+	if resp.ErrorCode != "" {
+		body["details"] = []map[string]string{{
+			"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			"errorCode": resp.ErrorCode,
+		}}
+	}
+	writeJSON(w, resp.StatusCode, map[string]interface{}{"error": body})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
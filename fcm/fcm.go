@@ -0,0 +1,247 @@
+// Package fcm sends messages to Android devices with the Firebase Cloud Messaging HTTP v1 API,
+// authenticated with the OAuth2 access tokens of a Google service account.
+package fcm
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// DefaultEndpoint is the FCM HTTP v1 API
+	DefaultEndpoint = "https://fcm.googleapis.com"
+	// OAuth2 scope of the FCM API
+	messagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// Access tokens are renewed this long before they expire
+	tokenRefreshMargin = time.Minute
+	httpClientTimeout  = 30 * time.Second
+)
+
+// ErrorCodeUnregistered is the FCM error code of app instances no longer registered
+const ErrorCodeUnregistered = "UNREGISTERED"
+
+// Credentials is a Google service account key file
+type Credentials struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// LoadCredentials reads a service account JSON key file
+func LoadCredentials(path string) (*Credentials, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fcm credentials: %v", err)
+	}
+	var creds Credentials
+	if err := json.Unmarshal(bs, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse fcm credentials: %v", err)
+	}
+	switch {
+	case creds.Type != "service_account":
+		return nil, fmt.Errorf("invalid fcm credentials: type must be service_account, got %q", creds.Type)
+	case creds.ProjectID == "" || creds.ClientEmail == "" || creds.PrivateKey == "" || creds.TokenURI == "":
+		return nil, fmt.Errorf("invalid fcm credentials: project_id, client_email, private_key and token_uri are required")
+	}
+	return &creds, nil
+}
+
+// Message is an FCM message, see https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type Message struct {
+	Token        string            `json:"token"`
+	Notification *Notification     `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Android      *AndroidConfig    `json:"android,omitempty"`
+}
+
+type Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+type AndroidConfig struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// HIGH or NORMAL
+	Priority string `json:"priority,omitempty"`
+	// Time to live in seconds, such as "3600s"
+	TTL          string               `json:"ttl,omitempty"`
+	Notification *AndroidNotification `json:"notification,omitempty"`
+}
+
+type AndroidNotification struct {
+	Sound             string `json:"sound,omitempty"`
+	Tag               string `json:"tag,omitempty"`
+	NotificationCount *int   `json:"notification_count,omitempty"`
+}
+
+// Error is an error response of the FCM API
+type Error struct {
+	StatusCode int
+	// Canonical status, such as INVALID_ARGUMENT
+	Status string
+	// FCM error code, such as UNREGISTERED
+	ErrorCode string
+	Message   string
+}
+
+func (e *Error) Error() string {
+	code := e.ErrorCode
+	if code == "" {
+		code = e.Status
+	}
+	return fmt.Sprintf("fcm: %s: %s", code, e.Message)
+}
+
+// Client sends messages with the credentials of a service account
+type Client struct {
+	creds      *Credentials
+	key        *rsa.PrivateKey
+	endpoint   string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// NewClient creates a client sending to the endpoint, DefaultEndpoint unless overridden
+func NewClient(creds *Credentials, endpoint string) (*Client, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fcm private key: %v", err)
+	}
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &Client{
+		creds:      creds,
+		key:        key,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		httpClient: &http.Client{Timeout: httpClientTimeout},
+	}, nil
+}
+
+// ProjectID returns the Firebase project the messages are sent to
+func (c *Client) ProjectID() string {
+	return c.creds.ProjectID
+}
+
+// Send sends the message and returns its name, projects/<project>/messages/<id>
+func (c *Client) Send(msg *Message) (string, error) {
+	token, err := c.token()
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]*Message{"message": msg})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/projects/%s/messages:send", c.endpoint, c.creds.ProjectID), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", parseError(resp.StatusCode, respBody)
+	}
+	var result struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("fcm: invalid response: %v", err)
+	}
+	return result.Name, nil
+}
+
+func parseError(statusCode int, body []byte) error {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Type      string `json:"@type"`
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	e := &Error{StatusCode: statusCode, Message: http.StatusText(statusCode)}
+	if json.Unmarshal(body, &resp) == nil {
+		e.Status = resp.Error.Status
+		if resp.Error.Message != "" {
+			e.Message = resp.Error.Message
+		}
+		for _, detail := range resp.Error.Details {
+			if strings.HasSuffix(detail.Type, "google.firebase.fcm.v1.FcmError") {
+				e.ErrorCode = detail.ErrorCode
+			}
+		}
+	}
+	return e
+}
+
+// token returns an OAuth2 access token, renewed with a signed JWT assertion when expired
+func (c *Client) token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.accessToken != "" && now.Add(tokenRefreshMargin).Before(c.expiry) {
+		return c.accessToken, nil
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   c.creds.ClientEmail,
+		"scope": messagingScope,
+		"aud":   c.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	assertion.Header["kid"] = c.creds.PrivateKeyID
+	signed, err := assertion.SignedString(c.key)
+	if err != nil {
+		return "", fmt.Errorf("fcm: failed to sign token request: %v", err)
+	}
+
+	resp, err := c.httpClient.PostForm(c.creds.TokenURI, map[string][]string{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed},
+	})
+	if err != nil {
+		return "", fmt.Errorf("fcm: failed to get access token: %v", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("fcm: failed to get access token: %s %s", resp.Status, token.Error)
+	}
+	c.accessToken = token.AccessToken
+	c.expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.accessToken, nil
+}
@@ -0,0 +1,60 @@
+package netguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocked(t *testing.T) {
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1":         true,
+		"10.1.2.3":          true,
+		"172.16.0.1":        true,
+		"192.168.1.1":       true,
+		"169.254.169.254":   true,
+		"0.0.0.0":           true,
+		"::1":               true,
+		"fd00::1":           true,
+		"fe80::1":           true,
+		"::ffff:127.0.0.1":  true,
+		"0.1.2.3":           true,
+		"100.64.0.1":        true,
+		"100.127.255.254":   true,
+		"198.18.0.1":        true,
+		"198.19.255.255":    true,
+		"192.0.2.1":         true,
+		"224.0.0.1":         true,
+		"255.255.255.255":   true,
+		"::":                true,
+		"64:ff9b::a01:203":  true,
+		"64:ff9b::7f00:1":   true,
+		"2001:db8::1":       true,
+		"ff02::1":           true,
+		"::ffff:10.0.0.1":   true,
+		"::ffff:100.64.0.1": true,
+		"::ffff:0.0.0.0":    true,
+		"1.1.1.1":           false,
+		"100.128.0.1":       false,
+		"198.20.0.1":        false,
+		"::ffff:8.8.8.8":    false,
+		"2606:4700::1111":   false,
+	} {
+		if got := Blocked(netip.MustParseAddr(addr)); got != blocked {
+			t.Errorf("%s: blocked = %v, want %v", addr, got, blocked)
+		}
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := NewHTTPClient(time.Second).Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Fatalf("connected to the loopback: %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finb/bark-server/v2/apns"
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/fcm"
+	"github.com/finb/bark-server/v2/webhook"
+	"github.com/finb/bark-server/v2/webpush"
+	"github.com/mritd/logger"
+	"github.com/sideshow/apns2"
+	"github.com/urfave/cli/v2"
+)
+
+// Platforms of the registered devices, devices registered without a platform are iOS devices
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformWeb     = "web"
+	PlatformWebhook = "webhook"
+)
+
+// Notifier delivers the push messages to the devices of a platform, the message
+// carries the token of the device, the device its other platform settings
+type Notifier interface {
+	Push(device *database.Device, msg *Message) (*DeliveryResult, error)
+}
+
+// Message is a push message to one device in the terms shared by the platforms,
+// the notifiers convert the fields their platform supports
+type Message struct {
+	ID        string
+	DeviceKey string
+	// Token of the device on its platform
+	DeviceToken string
+	Title       string
+	Subtitle    string
+	Body        string
+	// Sound file name, e.g. alarm.caf
+	Sound string
+	// App icon badge, nil leaves the badge unchanged
+	Badge *int
+	// Custom parameters passed to the app as they were sent
+	Params map[string]interface{}
+	// Silent pushes and deletions carry the custom parameters only
+	Silent bool
+	// 10 delivers immediately, 5 lets the device save power and 1 is the lowest priority, 0 is the default
+	Priority   int
+	CollapseID string
+	// Zero means the default of the platform, the unix epoch means now or never
+	Expiration time.Time
+
+	// The APNs message the message was converted from, delivered as is to iOS devices
+	apns *apns.PushMessage
+}
+
+// newMessage converts a push message built with the APNs parameters
+func newMessage(msg *apns.PushMessage) *Message {
+	return &Message{
+		ID:          msg.Id,
+		DeviceKey:   msg.DeviceKey,
+		DeviceToken: msg.DeviceToken,
+		Title:       msg.Title,
+		Subtitle:    msg.Subtitle,
+		Body:        msg.Body,
+		Sound:       msg.Sound,
+		Badge:       msg.Badge,
+		Params:      msg.ExtParams,
+		Silent:      msg.IsDelete() || msg.PushType == apns2.PushTypeBackground,
+		Priority:    msg.Priority,
+		CollapseID:  msg.CollapseID,
+		Expiration:  msg.Expiration,
+		apns:        msg,
+	}
+}
+
+// DeliveryResult is the outcome of a delivery to a device of any platform
+type DeliveryResult struct {
+	// HTTP status code of the platform, 500 for connection errors
+	StatusCode int
+	// Error reason of the platform
+	Reason string
+	// Number of retries after transient failures
+	Retries int
+	// The platform reported the device token is no longer valid, the device is invalidated
+	Unregistered bool
+	// When the platform confirmed the token was no longer valid, zero means now
+	UnregisteredAt time.Time
+	// apns-id and apns-unique-id of APNs deliveries
+	ApnsID       string
+	ApnsUniqueID string
+}
+
+// apnsResult converts the result of an APNs push, the tokens APNs reports unregistered
+// or rejects as BadDeviceToken are no longer valid
+func apnsResult(res *apns.PushResult) *DeliveryResult {
+	return &DeliveryResult{
+		StatusCode:     res.StatusCode,
+		Reason:         res.Reason,
+		Retries:        res.Retries,
+		Unregistered:   res.StatusCode == http.StatusGone || (res.StatusCode == http.StatusBadRequest && res.Reason == apns2.ReasonBadDeviceToken),
+		UnregisteredAt: res.Timestamp,
+		ApnsID:         res.ApnsID,
+		ApnsUniqueID:   res.ApnsUniqueID,
+	}
+}
+
+// apnsNotifier delivers the push messages to iOS devices with APNs
+type apnsNotifier struct{}
+
+func (apnsNotifier) Push(_ *database.Device, msg *Message) (*DeliveryResult, error) {
+	res, err := apns.Push(msg.apns)
+	return apnsResult(res), err
+}
+
+var notifiersLock sync.RWMutex
+var notifiers = map[string]Notifier{
+	PlatformIOS: apnsNotifier{},
+}
+
+// setNotifier sets the notifier of the platform, nil disables the platform
+func setNotifier(platform string, notifier Notifier) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	if notifier == nil {
+		delete(notifiers, platform)
+		return
+	}
+	notifiers[platform] = notifier
+}
+
+// notifierFor returns the notifier of the device platform
+func notifierFor(platform string) (Notifier, error) {
+	if platform == "" {
+		platform = PlatformIOS
+	}
+	notifiersLock.RLock()
+	defer notifiersLock.RUnlock()
+	notifier, ok := notifiers[platform]
+	if !ok {
+		return nil, fmt.Errorf("pushes to %s devices are not configured", platform)
+	}
+	return notifier, nil
+}
+
+// parsePlatform validates the platform of a device registration, empty means iOS, web devices
+// register with /webpush/register and webhook targets with /webhook/register
+func parsePlatform(platform string) (string, error) {
+	switch strings.ToLower(platform) {
+	case "", PlatformIOS:
+		return PlatformIOS, nil
+	case PlatformAndroid:
+		return PlatformAndroid, nil
+	default:
+		return "", fmt.Errorf("invalid platform: %s, must be ios or android", platform)
+	}
+}
+
+// setupFCM enables the Android devices when FCM credentials are configured
+func setupFCM(c *cli.Context) error {
+	path := c.String("fcm-credentials-file")
+	if path == "" {
+		setNotifier(PlatformAndroid, nil)
+		return nil
+	}
+	creds, err := fcm.LoadCredentials(path)
+	if err != nil {
+		return err
+	}
+	client, err := fcm.NewClient(creds, c.String("fcm-endpoint"))
+	if err != nil {
+		return err
+	}
+	setNotifier(PlatformAndroid, &fcmNotifier{client: client})
+	logger.Infof("init fcm client success, project: %s", client.ProjectID())
+	return nil
+}
+
+// fcmNotifier delivers the push messages to Android devices with FCM
+type fcmNotifier struct {
+	client *fcm.Client
+}
+
+func (n *fcmNotifier) Push(_ *database.Device, msg *Message) (*DeliveryResult, error) {
+	_, err := n.client.Send(fcmMessage(msg))
+	if err == nil {
+		return &DeliveryResult{StatusCode: 200}, nil
+	}
+
+	var fcmErr *fcm.Error
+	if !errors.As(err, &fcmErr) {
+		return &DeliveryResult{StatusCode: 500}, err
+	}
+	reason := fcmErr.ErrorCode
+	if reason == "" {
+		reason = fcmErr.Status
+	}
+	return &DeliveryResult{
+		StatusCode:   fcmErr.StatusCode,
+		Reason:       reason,
+		Unregistered: fcmErr.ErrorCode == fcm.ErrorCodeUnregistered,
+	}, err
+}
+
+// fcmMessage converts a push message, silent pushes are sent as data messages
+func fcmMessage(msg *Message) *fcm.Message {
+	data := make(map[string]string, len(msg.Params)+2)
+	for k, v := range msg.Params {
+		// FCM data values are strings, other JSON types are sent encoded
+		if s, ok := v.(string); ok {
+			data[strings.ToLower(k)] = s
+		} else if bs, err := json.Marshal(v); err == nil {
+			data[strings.ToLower(k)] = string(bs)
+		}
+	}
+	if msg.Subtitle != "" {
+		data["subtitle"] = msg.Subtitle
+	}
+	data["sound"] = strings.TrimSuffix(msg.Sound, ".caf")
+
+	android := &fcm.AndroidConfig{
+		CollapseKey: msg.CollapseID,
+		Priority:    "HIGH",
+	}
+	if android.CollapseKey == "" {
+		android.CollapseKey = msg.ID
+	}
+	if !msg.Expiration.IsZero() {
+		android.TTL = fmt.Sprintf("%ds", int64(messageTTL(msg).Seconds()))
+	}
+
+	m := &fcm.Message{
+		Token:   msg.DeviceToken,
+		Data:    data,
+		Android: android,
+	}
+	if msg.Silent || msg.Priority == apns2.PriorityLow {
+		android.Priority = "NORMAL"
+	}
+	if msg.Silent {
+		data["title"], data["body"] = msg.Title, msg.Body
+		return m
+	}
+
+	image, _ := msg.Params["image"].(string)
+	m.Notification = &fcm.Notification{
+		Title: msg.Title,
+		Body:  msg.Body,
+		Image: image,
+	}
+	android.Notification = &fcm.AndroidNotification{
+		Sound:             "default",
+		Tag:               android.CollapseKey,
+		NotificationCount: msg.Badge,
+	}
+	return m
+}
+
+// Web Push messages without an expiration are kept as long as APNs keeps them
+const defaultWebPushTTL = 24 * time.Hour
+
+// messageTTL returns how long the message may be stored for an offline device
+func messageTTL(msg *Message) time.Duration {
+	if msg.Expiration.IsZero() {
+		return defaultWebPushTTL
+	}
+	ttl := time.Until(msg.Expiration)
+	if ttl < 0 || msg.Expiration.Unix() == 0 {
+		return 0
+	}
+	return ttl
+}
+
+// setupWebPush enables the browser devices with the VAPID key of the server, generated on first use
+func setupWebPush(c *cli.Context) error {
+	path := c.String("webpush-vapid-key")
+	if path == "" {
+		path = filepath.Join(c.String("data"), "vapid_private_key.pem")
+	}
+	key, created, err := webpush.LoadOrCreateVAPIDKey(path)
+	if err != nil {
+		// Servers without a writable data dir keep working without Web Push
+		setNotifier(PlatformWeb, nil)
+		logger.Warnf("web push disabled: %v", err)
+		return nil
+	}
+	if created {
+		logger.Infof("generated vapid key: %s", path)
+	}
+	client, err := webpush.NewClient(key, c.String("webpush-subject"), nil)
+	if err != nil {
+		return err
+	}
+	setNotifier(PlatformWeb, &webPushNotifier{client: client})
+	logger.Infof("init web push client success, vapid public key: %s", client.PublicKey())
+	return nil
+}
+
+// webPushNotifier delivers the push messages to browsers with Web Push
+type webPushNotifier struct {
+	client *webpush.Client
+}
+
+func (n *webPushNotifier) Push(device *database.Device, msg *Message) (*DeliveryResult, error) {
+	payload, err := json.Marshal(webPushPayload(msg))
+	if err != nil {
+		return &DeliveryResult{StatusCode: 400}, err
+	}
+	if len(payload) > webpush.MaxPayload {
+		return &DeliveryResult{StatusCode: http.StatusRequestEntityTooLarge},
+			fmt.Errorf("payload too large: %d bytes, the maximum is %d bytes", len(payload), webpush.MaxPayload)
+	}
+
+	opts := webpush.Options{
+		TTL:     int(messageTTL(msg).Seconds()),
+		Urgency: webpush.UrgencyHigh,
+		Topic:   msg.CollapseID,
+	}
+	if opts.Topic == "" {
+		opts.Topic = msg.ID
+	}
+	switch {
+	case msg.Silent || msg.Priority == 1:
+		opts.Urgency = webpush.UrgencyLow
+	case msg.Priority == apns2.PriorityLow:
+		opts.Urgency = webpush.UrgencyNormal
+	}
+
+	sub := &webpush.Subscription{
+		Endpoint: device.Token,
+		Keys:     webpush.Keys{P256dh: device.WebPushP256dh, Auth: device.WebPushAuth},
+	}
+	err = n.client.Send(sub, payload, opts)
+	if err == nil {
+		return &DeliveryResult{StatusCode: 200}, nil
+	}
+	var pushErr *webpush.Error
+	if !errors.As(err, &pushErr) {
+		return &DeliveryResult{StatusCode: 500}, err
+	}
+	return &DeliveryResult{
+		StatusCode: pushErr.StatusCode,
+		Reason:     http.StatusText(pushErr.StatusCode),
+		// The subscription expired or was removed
+		Unregistered: pushErr.StatusCode == http.StatusNotFound || pushErr.StatusCode == http.StatusGone,
+	}, err
+}
+
+// webPushPayload is the message handed to the service worker of the page, the
+// custom parameters such as url, icon and group are passed as they were sent
+func webPushPayload(msg *Message) map[string]interface{} {
+	pl := make(map[string]interface{}, len(msg.Params)+5)
+	for k, v := range msg.Params {
+		pl[strings.ToLower(k)] = v
+	}
+	pl["id"] = msg.ID
+	if msg.Silent {
+		pl["silent"] = true
+		return pl
+	}
+	pl["title"] = msg.Title
+	pl["subtitle"] = msg.Subtitle
+	pl["body"] = msg.Body
+	if msg.Badge != nil {
+		pl["badge"] = *msg.Badge
+	}
+	return pl
+}
+
+// setupWebhookTargets enables the device keys registered with webhook targets, the server
+// then sends requests to the registered URLs, so it is opt-in
+func setupWebhookTargets(c *cli.Context) error {
+	if !c.Bool("webhook-targets") {
+		setNotifier(PlatformWebhook, nil)
+		return nil
+	}
+	client, err := webhook.NewClient(webhook.RetryPolicy{
+		MaxAttempts: c.Int("webhook-retry-max-attempts"),
+		Backoff:     c.Duration("webhook-retry-backoff"),
+	}, c.Duration("webhook-timeout"), nil)
+	if err != nil {
+		return err
+	}
+	setNotifier(PlatformWebhook, &webhookNotifier{client: client})
+	return nil
+}
+
+// webhookNotifier delivers the push messages as HTTP requests to webhook targets
+type webhookNotifier struct {
+	client *webhook.Client
+}
+
+func (n *webhookNotifier) Push(device *database.Device, msg *Message) (*DeliveryResult, error) {
+	if device.Webhook == nil {
+		return &DeliveryResult{StatusCode: 400}, fmt.Errorf("device has no webhook target")
+	}
+	params := make(map[string]interface{}, len(msg.Params))
+	for k, v := range msg.Params {
+		params[strings.ToLower(k)] = v
+	}
+	target := &webhook.Target{
+		URL:          device.Webhook.URL,
+		Method:       device.Webhook.Method,
+		Headers:      device.Webhook.Headers,
+		BodyTemplate: device.Webhook.BodyTemplate,
+		Secret:       device.Webhook.Secret,
+	}
+	res, err := n.client.Send(target, &webhook.Message{
+		ID:        msg.ID,
+		DeviceKey: msg.DeviceKey,
+		Title:     msg.Title,
+		Subtitle:  msg.Subtitle,
+		Body:      msg.Body,
+		Params:    params,
+		Timestamp: time.Now().Unix(),
+	})
+	switch {
+	case err == nil:
+		return &DeliveryResult{StatusCode: 200, Retries: res.Retries}, nil
+	case res.StatusCode == 0:
+		return &DeliveryResult{StatusCode: 500, Retries: res.Retries}, err
+	default:
+		return &DeliveryResult{
+			StatusCode: res.StatusCode,
+			Reason:     http.StatusText(res.StatusCode),
+			Retries:    res.Retries,
+			// The receiver removed the webhook
+			Unregistered: res.StatusCode == http.StatusGone,
+		}, err
+	}
+}
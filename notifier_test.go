@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/fcm"
+	"github.com/finb/bark-server/v2/fcm/fakefcm"
+	"github.com/finb/bark-server/v2/webhook"
+	"github.com/finb/bark-server/v2/webpush"
+	"github.com/finb/bark-server/v2/webpush/fakewebpush"
+)
+
+const fcmToken = "fcm-registration-token"
+
+// useFake installs the client of a fake service with set until the test ends, set is
+// then called with the zero value, so the fake doesn't leak into the following tests
+func useFake[C any](t *testing.T, set func(C), client C) {
+	set(client)
+	t.Cleanup(func() {
+		var zero C
+		set(zero)
+	})
+}
+
+// platformNotifier returns the setter of the notifier of the platform
+func platformNotifier(platform string) func(Notifier) {
+	return func(n Notifier) { setNotifier(platform, n) }
+}
+
+// startFakeFCM enables Android devices with a client of a fake FCM server
+func startFakeFCM(t *testing.T) *fakefcm.Server {
+	fakeFCM := fakefcm.New()
+	server := httptest.NewServer(fakeFCM)
+	t.Cleanup(server.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := fcm.NewClient(&fcm.Credentials{
+		Type:        "service_account",
+		ProjectID:   "bark-test",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		ClientEmail: "bark@bark-test.iam.gserviceaccount.com",
+		TokenURI:    server.URL + fakefcm.TokenPath,
+	}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFake[Notifier](t, platformNotifier(PlatformAndroid), &fcmNotifier{client: client})
+	return fakeFCM
+}
+
+func TestFCM(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+	defer fakeAPNs.Reset()
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Android registration without FCM",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           `{"device_key":"` + key + `","device_token":"` + fcmToken + `","platform":"android"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Android push without FCM",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 400,
+			WantBody:       "pushes to android devices are not configured",
+		},
+		{
+			Name:           "Invalid platform",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           `{"device_key":"` + key + `","device_token":"` + fcmToken + `","platform":"windows"}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	fakeFCM := startFakeFCM(t)
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Android push",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","title":"title","subtitle":"subtitle","body":"body","badge":3,"url":"https://day.app","count":2,"collapse_id":"news"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Android silent push",
+			Method:         "GET",
+			URL:            "/" + key + "/sync?silent=1&refresh=feed",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Live activities are iOS only",
+			Method:         "POST",
+			URL:            "/live-activity/update",
+			Body:           `{"device_key":"` + key + `","content_state":{"progress":1}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	if n := len(fakeAPNs.Notifications()); n != 0 {
+		t.Fatalf("android pushes were sent to APNs: %d", n)
+	}
+	messages := fakeFCM.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("want 2 fcm messages, got %d", len(messages))
+	}
+	m := messages[0]
+	if m.ProjectID != "bark-test" || m.Authorization != "Bearer "+fakefcm.AccessToken || m.Message.Token != fcmToken {
+		t.Fatalf("unexpected fcm request: %+v", m)
+	}
+	if m.Message.Notification == nil || m.Message.Notification.Title != "title" || m.Message.Notification.Body != "body" ||
+		m.Message.Data["subtitle"] != "subtitle" || m.Message.Data["url"] != "https://day.app" || m.Message.Data["count"] != "2" ||
+		m.Message.Android.CollapseKey != "news" || m.Message.Android.Priority != "HIGH" ||
+		m.Message.Android.Notification.NotificationCount == nil || *m.Message.Android.Notification.NotificationCount != 3 {
+		t.Fatalf("unexpected fcm message: %+v", m.Message)
+	}
+	if m := messages[1].Message; m.Notification != nil || m.Android.Priority != "NORMAL" || m.Data["body"] != "sync" || m.Data["refresh"] != "feed" {
+		t.Fatalf("unexpected fcm data message: %+v", m)
+	}
+
+	fakeFCM.Respond(fcmToken, fakefcm.Response{StatusCode: 404, Status: "NOT_FOUND", ErrorCode: fcm.ErrorCodeUnregistered})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Unregistered FCM token",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Invalidated FCM token",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 400,
+			WantBody:       "register the device again",
+		},
+	})
+	if device, _ := db.DeviceByKey(key); device.Platform != PlatformAndroid || device.InvalidReason != fcm.ErrorCodeUnregistered {
+		t.Fatalf("unexpected device: %+v", device)
+	}
+}
+
+// startFakeWebPush enables browser devices with a client of a fake Web Push service
+func startFakeWebPush(t *testing.T) (*fakewebpush.Server, string) {
+	fakeWebPush := fakewebpush.New()
+	server := httptest.NewTLSServer(fakeWebPush)
+	t.Cleanup(server.Close)
+
+	key, created, err := webpush.LoadOrCreateVAPIDKey(filepath.Join(t.TempDir(), "vapid.pem"))
+	if err != nil || !created {
+		t.Fatalf("failed to generate vapid key: %v", err)
+	}
+	// The fake service listens on the loopback, the default client refuses to connect to it
+	client, err := webpush.NewClient(key, "mailto:bark@example.com", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFake[Notifier](t, platformNotifier(PlatformWeb), &webPushNotifier{client: client})
+	return fakeWebPush, server.URL
+}
+
+func TestVAPIDKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "vapid.pem")
+	key, created, err := webpush.LoadOrCreateVAPIDKey(path)
+	if err != nil || !created {
+		t.Fatalf("failed to generate vapid key: %v", err)
+	}
+	loaded, created, err := webpush.LoadOrCreateVAPIDKey(path)
+	if err != nil || created || !loaded.Equal(key) {
+		t.Fatalf("the vapid key was not kept: %v", err)
+	}
+}
+
+func TestWebPush(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "VAPID public key without Web Push",
+			Method:         "GET",
+			URL:            "/webpush/vapid-public-key",
+			WantStatusCode: 501,
+		},
+	})
+
+	fakeWebPush, baseURL := startFakeWebPush(t)
+	sub, err := fakeWebPush.Subscribe(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, _ := json.Marshal(sub)
+	subID := sub.Endpoint[strings.LastIndex(sub.Endpoint, "/")+1:]
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "VAPID public key",
+			Method:         "GET",
+			URL:            "/webpush/vapid-public-key",
+			WantStatusCode: 200,
+			WantBody:       "public_key",
+		},
+		{
+			Name:           "Invalid subscription",
+			Method:         "POST",
+			URL:            "/webpush/register",
+			Body:           `{"device_key":"` + key + `","subscription":{"endpoint":"` + sub.Endpoint + `","keys":{"p256dh":"` + sub.Keys.P256dh + `","auth":"c2hvcnQ"}}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+			WantBody:       "invalid subscription auth secret",
+		},
+		{
+			Name:           "Register subscription",
+			Method:         "POST",
+			URL:            "/webpush/register",
+			Body:           `{"device_key":"` + key + `","subscription":` + string(subscription) + `}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Web push",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","title":"title","body":"body","url":"https://day.app","icon":"https://day.app/icon.png","badge":2,"collapse_id":"news"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Web silent push",
+			Method:         "GET",
+			URL:            "/" + key + "?silent=1&refresh=feed",
+			WantStatusCode: 200,
+		},
+	})
+
+	messages := fakeWebPush.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("want 2 web push messages, got %d", len(messages))
+	}
+	var pl map[string]interface{}
+	if err := json.Unmarshal(messages[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if m := messages[0]; m.SubscriptionID != subID || m.Subject != "mailto:bark@example.com" || m.TTL != "86400" || m.Urgency != "high" || m.Topic != "news" ||
+		pl["title"] != "title" || pl["body"] != "body" || pl["url"] != "https://day.app" || pl["icon"] != "https://day.app/icon.png" || pl["badge"] != 2.0 {
+		t.Fatalf("unexpected web push message: %+v %s", m, m.Payload)
+	}
+	if err := json.Unmarshal(messages[1].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if m := messages[1]; m.Urgency != "low" || pl["silent"] != true || pl["refresh"] != "feed" {
+		t.Fatalf("unexpected web silent push: %+v %s", m, m.Payload)
+	}
+
+	fakeWebPush.Respond(subID, 410)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Expired subscription",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Invalidated subscription",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 400,
+			WantBody:       "register the device again",
+		},
+	})
+}
+
+// webhookReceiver records the requests of a webhook target, the scripted status codes are returned first
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	statuses []int
+}
+
+func (rv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.requests = append(rv.requests, r)
+	rv.bodies = append(rv.bodies, string(body))
+	if len(rv.statuses) > 0 {
+		w.WriteHeader(rv.statuses[0])
+		rv.statuses = rv.statuses[1:]
+	}
+}
+
+func TestWebhookTarget(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Webhook targets disabled",
+			Method:         "POST",
+			URL:            "/webhook/register",
+			Body:           `{"device_key":"` + key + `","url":"` + server.URL + `"}`,
+			IsJson:         true,
+			WantStatusCode: 501,
+		},
+	})
+
+	// The receiver listens on the loopback, the default client refuses to connect to it
+	client, err := webhook.NewClient(webhook.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}, time.Second, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFake[Notifier](t, platformNotifier(PlatformWebhook), &webhookNotifier{client: client})
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Invalid webhook method",
+			Method:         "POST",
+			URL:            "/webhook/register",
+			Body:           `{"device_key":"` + key + `","url":"` + server.URL + `","method":"DELETE"}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Invalid webhook body template",
+			Method:         "POST",
+			URL:            "/webhook/register",
+			Body:           `{"device_key":"` + key + `","url":"` + server.URL + `","body_template":"{{.Missing}}"}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+			WantBody:       "invalid webhook body template",
+		},
+		{
+			Name:   "Register webhook",
+			Method: "POST",
+			URL:    "/webhook/register",
+			Body: `{"device_key":"` + key + `","url":"` + server.URL + `/hook","method":"PUT","headers":{"Authorization":"Bearer room"},` +
+				`"body_template":"{\"text\": {{json (printf \"%s: %s\" .Title .Body)}}, \"link\": {{json .Params.url}}}","secret":"s3cret"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Webhook push",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","title":"title","body":"body \"quoted\"","url":"https://day.app","id":"delivery-1"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+	})
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("want 1 webhook request, got %d", len(receiver.requests))
+	}
+	r, body := receiver.requests[0], receiver.bodies[0]
+	if r.Method != "PUT" || r.URL.Path != "/hook" || r.Header.Get("Authorization") != "Bearer room" || r.Header.Get("Content-Type") != "application/json" ||
+		r.Header.Get(webhook.DeliveryHeader) != "delivery-1" || body != `{"text": "title: body \"quoted\"", "link": "https://day.app"}` {
+		t.Fatalf("unexpected webhook request: %s %s %v %s", r.Method, r.URL, r.Header, body)
+	}
+	timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+	if r.Header.Get(webhook.SignatureHeader) != webhook.Sign("s3cret", timestamp, []byte(body)) {
+		t.Fatalf("invalid webhook signature: %s", r.Header.Get(webhook.SignatureHeader))
+	}
+
+	// The secret of the URL is kept when the key registers again, and not returned again
+	req := httptest.NewRequest("POST", "/webhook/register", strings.NewReader(`{"device_key":"`+key+`","url":"`+server.URL+`/hook"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := io.ReadAll(resp.Body); resp.StatusCode != 200 || strings.Contains(string(bs), "secret") {
+		t.Fatalf("unexpected registration response: %d %s", resp.StatusCode, bs)
+	}
+	if device, _ := db.DeviceByKey(key); device.Webhook.Secret != "s3cret" {
+		t.Fatalf("the webhook secret was not kept: %+v", device.Webhook)
+	}
+
+	// A new URL gets a new secret, the message is sent as JSON without a template
+	receiver.requests, receiver.bodies, receiver.statuses = nil, nil, []int{503}
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Register another webhook URL",
+			Method:         "POST",
+			URL:            "/webhook/register",
+			Body:           `{"device_key":"` + key + `","url":"` + server.URL + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"secret":"`,
+		},
+		{
+			Name:           "Webhook push retried",
+			Method:         "GET",
+			URL:            "/" + key + "/title/body?group=ops",
+			WantStatusCode: 200,
+			WantBody:       `"retries":1`,
+		},
+	})
+	if len(receiver.requests) != 2 {
+		t.Fatalf("want 2 webhook requests, got %d", len(receiver.requests))
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(receiver.bodies[1]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.requests[1].Method != "POST" || msg["title"] != "title" || msg["body"] != "body" || msg["group"] != "ops" || msg["device_key"] != key {
+		t.Fatalf("unexpected webhook message: %s", receiver.bodies[1])
+	}
+
+	receiver.statuses = []int{410}
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Removed webhook",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Invalidated webhook",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 400,
+			WantBody:       "register the device again",
+		},
+	})
+}
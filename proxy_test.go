@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/finb/bark-server/v2/apns"
+)
+
+// proxyStandIn is a local HTTP CONNECT or SOCKS5 proxy recording the tunnels it opened
+type proxyStandIn struct {
+	listener net.Listener
+	user     string
+	password string
+
+	mu      sync.Mutex
+	tunnels []string
+}
+
+func newProxyStandIn(t *testing.T, socks5 bool, user, password string) *proxyStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxyStandIn{listener: l, user: user, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if socks5 {
+				go p.serveSOCKS5(conn)
+			} else {
+				go p.serveCONNECT(conn)
+			}
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *proxyStandIn) Tunnels() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.tunnels...)
+}
+
+func (p *proxyStandIn) serveCONNECT(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+	if req.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	p.tunnel(conn, req.Host, "HTTP/1.1 200 Connection established\r\n\r\n")
+}
+
+func (p *proxyStandIn) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// greeting: version, methods, only username/password authentication is accepted
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// username/password authentication (RFC 1929)
+	readString := func() string {
+		n, _ := r.ReadByte()
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	if version, _ := r.ReadByte(); version != 1 {
+		return
+	}
+	if readString() != p.user || readString() != p.password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	// request: version, CONNECT, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readString()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	p.tunnel(&bufferedConn{conn, r}, addr, string([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}))
+}
+
+func (p *proxyStandIn) tunnel(conn net.Conn, addr, established string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	p.mu.Lock()
+	p.tunnels = append(p.tunnels, addr)
+	p.mu.Unlock()
+
+	io.WriteString(conn, established)
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestAPNsProxy(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer func() {
+		if err := apns.ReCreateAPNS(fakeAPNsConfig()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	gateway := fakeAPNsURL[len("http://"):]
+	for _, tt := range []struct {
+		name   string
+		socks5 bool
+		scheme string
+	}{
+		{"HTTP CONNECT proxy", false, "http"},
+		{"SOCKS5 proxy", true, "socks5"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newProxyStandIn(t, tt.socks5, "bark", "secret")
+
+			cfg := fakeAPNsConfig()
+			cfg.Proxy = tt.scheme + "://bark:wrong@" + proxy.listener.Addr().String()
+			if err := apns.ReCreateAPNS(cfg); err != nil {
+				t.Fatal(err)
+			}
+			Endpoint(t, []APITestCase{
+				{
+					Name:           "Proxy authentication failed",
+					Method:         "GET",
+					URL:            "/" + key + "/body",
+					WantStatusCode: 500,
+				},
+			})
+
+			cfg.Proxy = tt.scheme + "://bark:secret@" + proxy.listener.Addr().String()
+			if err := apns.ReCreateAPNS(cfg); err != nil {
+				t.Fatal(err)
+			}
+			fakeAPNs.Reset()
+			Endpoint(t, []APITestCase{
+				{
+					Name:           "Push through proxy",
+					Method:         "GET",
+					URL:            "/" + key + "/body",
+					WantStatusCode: 200,
+				},
+			})
+			if tunnels := proxy.Tunnels(); len(tunnels) != 1 || tunnels[0] != gateway {
+				t.Fatalf("want a tunnel to %s, got %v", gateway, tunnels)
+			}
+			if len(fakeAPNs.Notifications()) != 1 {
+				t.Fatalf("want 1 notification through the proxy, got %d", len(fakeAPNs.Notifications()))
+			}
+		})
+	}
+
+	cfg := apns.DefaultConfig()
+	cfg.Proxy = "ftp://proxy:21"
+	if err := apns.ReCreateAPNS(cfg); err == nil {
+		t.Fatal("want error for unsupported proxy scheme")
+	}
+}
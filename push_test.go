@@ -2,35 +2,64 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"io"
 
+	"github.com/finb/bark-server/v2/apns"
+	"github.com/finb/bark-server/v2/apns/fakeapns"
 	"github.com/finb/bark-server/v2/database"
 	"github.com/gofiber/fiber/v2"
 	jsoniter "github.com/json-iterator/go"
 )
 
-// Before running the tests, a valid deviceToken must be set. Otherwise, the tests will fail.
+// The tests push to a fake APNs server, so any deviceToken works.
 const (
-	deviceToken = ""
+	deviceToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 	key         = "MemoryBaseKey"
 )
 
 var app *fiber.App
+var fakeAPNs *fakeapns.Server
+
+// Gateway URL of the fake APNs server
+var fakeAPNsURL string
 
 func TestMain(m *testing.M) {
-	if deviceToken == "" {
-		panic("deviceToken is not set")
+	fakeAPNs = fakeapns.New()
+	fakeAPNsServer := httptest.NewServer(fakeAPNs.Handler())
+	defer fakeAPNsServer.Close()
+
+	fakeAPNsURL = fakeAPNsServer.URL
+	if err := apns.ReCreateAPNS(fakeAPNsConfig()); err != nil {
+		panic(err)
 	}
+
 	db = database.NewMemBase()
-	db.SaveDeviceTokenByKey(key, deviceToken)
+	db.SaveDevice(key, &database.Device{Token: deviceToken})
 	app = NewServer()
 	m.Run()
 }
 
+// fakeAPNsConfig returns the APNs configuration pushing to the fake APNs server,
+// the retries are quick to keep the tests fast
+func fakeAPNsConfig() apns.Config {
+	cfg := apns.DefaultConfig()
+	cfg.Host = fakeAPNsURL
+	cfg.RetryPolicy.Backoff = time.Millisecond
+	return cfg
+}
+
 func TestRegister(t *testing.T) {
 	Endpoint(t, []APITestCase{
 		{
@@ -68,6 +97,40 @@ func TestRegister(t *testing.T) {
 	})
 }
 
+func TestRegisterKeepsSettings(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	// The settings of a record without a valid token are kept as well
+	_, err := db.SaveDevice(key, &database.Device{
+		ActivityToken:  "activity-token",
+		FallbackEmail:  "me@example.com",
+		ReceiverSecret: "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeviceByKey(key); err == nil {
+		t.Fatal("want the record without token to be invalid")
+	}
+
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Register again",
+			Method:         "GET",
+			URL:            "/register?key=" + key + "&devicetoken=" + deviceToken,
+			WantStatusCode: 200,
+		},
+	})
+	device, err := db.DeviceByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Token != deviceToken || device.ActivityToken != "activity-token" ||
+		device.FallbackEmail != "me@example.com" || device.ReceiverSecret != "s3cret" {
+		t.Fatalf("settings not kept: %+v", device)
+	}
+}
+
 func TestPushTitleAndBody(t *testing.T) {
 	// Correct push
 	Endpoint(t, []APITestCase{
@@ -264,13 +327,868 @@ func TestBatchPush(t *testing.T) {
 	})
 }
 
+func TestPushAPNsErrors(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Push delivered to APNs",
+			Method:         "GET",
+			URL:            "/" + key + "/title/body",
+			WantStatusCode: 200,
+		},
+	})
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 1 {
+		t.Fatalf("want 1 notification, got %d", len(notifications))
+	}
+	if n := notifications[0]; n.DeviceToken != deviceToken || n.Topic != "me.fin.bark" || !strings.Contains(string(n.Payload), `"body":"body"`) {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+
+	// Transient errors are retried
+	fakeAPNs.Script(deviceToken,
+		fakeapns.Response{StatusCode: 429, Reason: "TooManyRequests"},
+		fakeapns.Response{StatusCode: 503, Reason: "ServiceUnavailable"},
+	)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "APNs transient errors retried",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 200,
+			WantBody:       `"retries":2`,
+		},
+	})
+
+	fakeAPNs.Script(deviceToken,
+		fakeapns.Response{StatusCode: 500, Reason: "InternalServerError"},
+		fakeapns.Response{StatusCode: 500, Reason: "InternalServerError"},
+		fakeapns.Response{StatusCode: 500, Reason: "InternalServerError"},
+	)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "APNs internal server error",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+			WantBody:       `"retries":2`,
+		},
+	})
+
+	// Unregistered device token is never retried and kept in the database marked invalid
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 410, Reason: "Unregistered"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "APNs unregistered device token",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+			WantBody:       `"retries":0`,
+		},
+		{
+			Name:           "Push after device token invalidated",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 400,
+			WantBody:       "invalidated by its push service",
+		},
+		{
+			Name:           "Register check reports the invalidation",
+			Method:         "GET",
+			URL:            "/register/" + key,
+			WantStatusCode: 400,
+			WantBody:       `"invalid_reason":"Unregistered"`,
+		},
+	})
+	if device, err := db.DeviceByKey(key); err != nil || device.Token != deviceToken || device.InvalidatedAt == 0 {
+		t.Fatalf("want the invalidated token kept, got %+v, %v", device, err)
+	}
+
+	// Registering again validates the token
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Register again",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           "device_key=" + key + "&device_token=" + deviceToken,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Register check after registering again",
+			Method:         "GET",
+			URL:            "/register/" + key,
+			WantStatusCode: 200,
+		},
+	})
+
+	// A token registered after the time APNs reports it invalid stays valid
+	db.SaveDevice(key, &database.Device{Token: deviceToken, RegisteredAt: time.Now().Add(time.Hour).Unix()})
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 410, Reason: "Unregistered"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "APNs unregistered a previous token",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Push after previous token unregistered",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 200,
+		},
+	})
+	db.SaveDevice(key, &database.Device{Token: deviceToken})
+}
+
+// reregisteringNotifier registers the device again with another token during the push,
+// then reports the token pushed to as unregistered, or accepted with accept
+type reregisteringNotifier struct {
+	token  string
+	accept bool
+}
+
+func (n *reregisteringNotifier) Push(device *database.Device, msg *Message) (*DeliveryResult, error) {
+	if _, err := db.SaveDevice(msg.DeviceKey, &database.Device{Token: n.token, Platform: PlatformAndroid}); err != nil {
+		return &DeliveryResult{StatusCode: 500}, err
+	}
+	if n.accept {
+		return &DeliveryResult{StatusCode: 200}, nil
+	}
+	return &DeliveryResult{StatusCode: 404, Reason: "UNREGISTERED", Unregistered: true}, fmt.Errorf("UNREGISTERED")
+}
+
+func TestPushInvalidationKeepsNewRegistration(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	useFake[Notifier](t, platformNotifier(PlatformAndroid), &reregisteringNotifier{token: fcmToken})
+	if _, err := db.SaveDevice(key, &database.Device{Token: "stale-fcm-token", Platform: PlatformAndroid}); err != nil {
+		t.Fatal(err)
+	}
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Token unregistered while the device registered again",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+	})
+	if device, err := db.DeviceByKey(key); err != nil || device.Token != fcmToken || device.IsInvalidated() {
+		t.Fatalf("want the new registration kept valid, got %+v, %v", device, err)
+	}
+}
+
+func TestPushDeliveryKeepsNewRegistration(t *testing.T) {
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	useFake[Notifier](t, platformNotifier(PlatformAndroid), &reregisteringNotifier{token: fcmToken, accept: true})
+	if _, err := db.SaveDevice(key, &database.Device{Token: "stale-fcm-token", Platform: PlatformAndroid}); err != nil {
+		t.Fatal(err)
+	}
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Push delivered while the device registered again",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 200,
+		},
+	})
+	if device, err := db.DeviceByKey(key); err != nil || device.Token != fcmToken || device.DeliveredAt != 0 {
+		t.Fatalf("want the new registration kept undelivered, got %+v, %v", device, err)
+	}
+}
+
+func TestPushHeaders(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Default headers",
+			Method:         "GET",
+			URL:            "/" + key + "/body?id=message-id",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Custom headers",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","body":"body","priority":5,"expiration":0,"collapse_id":"weather"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Background push",
+			Method:         "GET",
+			URL:            "/" + key + "/body?push_type=background&expiration=1700000000",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalid priority",
+			Method:         "GET",
+			URL:            "/" + key + "/body?priority=7",
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Invalid push type",
+			Method:         "GET",
+			URL:            "/" + key + "/body?push_type=mdm",
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Push type of an app extension",
+			Method:         "GET",
+			URL:            "/" + key + "/body?push_type=voip",
+			WantStatusCode: 400,
+			WantBody:       "must be alert or background",
+		},
+		{
+			Name:           "Background push with high priority",
+			Method:         "GET",
+			URL:            "/" + key + "/body?push_type=background&priority=10",
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 3 {
+		t.Fatalf("want 3 notifications, got %d", len(notifications))
+	}
+	if n := notifications[0]; n.PushType != "alert" || n.Priority != "" || n.CollapseID != "message-id" || n.Expiration == "" {
+		t.Fatalf("unexpected default headers: %+v", n)
+	}
+	if n := notifications[1]; n.Priority != "5" || n.Expiration != "0" || n.CollapseID != "weather" || strings.Contains(string(n.Payload), "priority") {
+		t.Fatalf("unexpected custom headers: %+v", n)
+	}
+	if n := notifications[2]; n.PushType != "background" || n.Priority != "5" || n.Expiration != "1700000000" || !strings.Contains(string(n.Payload), `"content-available":1`) {
+		t.Fatalf("unexpected background push: %+v", n)
+	}
+}
+
+func TestPushPayloadLimit(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer func() {
+		if err := apns.ReCreateAPNS(fakeAPNsConfig()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	longBody := strings.Repeat("推送", 1000)
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Oversized body truncated",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","title":"title","group":"group","body":"` + longBody + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Oversized ciphertext can't be truncated",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","ciphertext":"` + strings.Repeat("a", 5000) + `"}`,
+			IsJson:         true,
+			WantStatusCode: 413,
+			WantBody:       "payload too large",
+		},
+	})
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 1 {
+		t.Fatalf("want 1 notification, got %d", len(notifications))
+	}
+	var pl struct {
+		Aps struct {
+			Alert struct {
+				Title string `json:"title"`
+				Body  string `json:"body"`
+			} `json:"alert"`
+			ThreadID string `json:"thread-id"`
+		} `json:"aps"`
+		Group string `json:"group"`
+	}
+	if err := json.Unmarshal(notifications[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications[0].Payload) > apns.PayloadMaximum || !utf8.ValidString(pl.Aps.Alert.Body) ||
+		!strings.HasSuffix(pl.Aps.Alert.Body, "…") || !strings.HasPrefix(longBody, strings.TrimSuffix(pl.Aps.Alert.Body, "…")) {
+		t.Fatalf("unexpected truncated body: %d bytes, %s", len(notifications[0].Payload), pl.Aps.Alert.Body)
+	}
+	if pl.Aps.Alert.Title != "title" || pl.Aps.ThreadID != "group" || pl.Group != "group" {
+		t.Fatalf("unexpected truncated payload: %s", notifications[0].Payload)
+	}
+
+	cfg := fakeAPNsConfig()
+	cfg.PayloadMode = apns.PayloadModeReject
+	if err := apns.ReCreateAPNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Oversized body rejected",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","body":"` + longBody + `"}`,
+			IsJson:         true,
+			WantStatusCode: 413,
+			WantBody:       "the maximum is 4096 bytes",
+		},
+	})
+}
+
+func TestPushCustomParamTypes(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:   "JSON types kept",
+			Method: "POST",
+			URL:    "/push",
+			Body: `{"device_key":"` + key + `","body":"body","badge":3,"count":2,"flag":true,"list":[1,"a"],` +
+				`"ext":{"nested":{"k":1}},"sound":{"critical":1,"name":"alarm","volume":0.5}}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "V1 badge",
+			Method:         "GET",
+			URL:            "/" + key + "/body?badge=7&sound=bell",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalid badge",
+			Method:         "GET",
+			URL:            "/" + key + "/body?badge=abc",
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Invalid sound volume",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","body":"body","sound":{"name":"alarm","volume":2}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	var pl map[string]interface{}
+	if err := json.Unmarshal(notifications[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	aps := pl["aps"].(map[string]interface{})
+	want := map[string]interface{}{
+		"badge":  3.0,
+		"count":  2.0,
+		"flag":   true,
+		"list":   []interface{}{1.0, "a"},
+		"nested": map[string]interface{}{"k": 1.0},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(pl[k], v) {
+			t.Fatalf("want custom field %s = %v, got %v", k, v, pl[k])
+		}
+	}
+	wantSound := map[string]interface{}{"critical": 1.0, "name": "alarm.caf", "volume": 0.5}
+	if aps["badge"] != 3.0 || !reflect.DeepEqual(aps["sound"], wantSound) {
+		t.Fatalf("unexpected aps: %v", aps)
+	}
+
+	if !strings.Contains(string(notifications[1].Payload), `"badge":7`) || !strings.Contains(string(notifications[1].Payload), `"sound":"bell.caf"`) {
+		t.Fatalf("unexpected V1 payload: %s", notifications[1].Payload)
+	}
+}
+
+func TestPushApsFields(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:   "Native aps fields",
+			Method: "POST",
+			URL:    "/push",
+			Body: `{"device_key":"` + key + `","body":"body","level":"timeSensitive","relevance_score":0.8,` +
+				`"target_content_id":"window","filter_criteria":"work"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Critical alert",
+			Method:         "GET",
+			URL:            "/" + key + "/body?level=critical&volume=8&sound=alarm",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Critical alert with the default sound",
+			Method:         "GET",
+			URL:            "/" + key + "/body?level=critical",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalid level",
+			Method:         "GET",
+			URL:            "/" + key + "/body?level=loud",
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Invalid relevance score",
+			Method:         "GET",
+			URL:            "/" + key + "/body?relevance_score=2",
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 3 {
+		t.Fatalf("want 3 notifications, got %d", len(notifications))
+	}
+	var pl struct {
+		Aps   map[string]interface{} `json:"aps"`
+		Level string                 `json:"level"`
+	}
+	if err := json.Unmarshal(notifications[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"interruption-level": "time-sensitive",
+		"relevance-score":    0.8,
+		"target-content-id":  "window",
+		"filter-criteria":    "work",
+	}
+	for k, v := range want {
+		if pl.Aps[k] != v {
+			t.Fatalf("want aps field %s = %v, got %v", k, v, pl.Aps[k])
+		}
+	}
+	if pl.Level != "timeSensitive" || pl.Aps["alert"].(map[string]interface{})["body"] != "body" {
+		t.Fatalf("unexpected payload: %s", notifications[0].Payload)
+	}
+
+	pl.Aps = nil
+	if err := json.Unmarshal(notifications[1].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	wantSound := map[string]interface{}{"critical": 1.0, "name": "alarm.caf", "volume": 0.8}
+	if pl.Aps["interruption-level"] != "critical" || !reflect.DeepEqual(pl.Aps["sound"], wantSound) {
+		t.Fatalf("unexpected critical alert: %s", notifications[1].Payload)
+	}
+
+	pl.Aps = nil
+	if err := json.Unmarshal(notifications[2].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	wantSound = map[string]interface{}{"critical": 1.0, "name": "1107.caf", "volume": 0.5}
+	if !reflect.DeepEqual(pl.Aps["sound"], wantSound) {
+		t.Fatalf("unexpected critical alert sound: %s", notifications[2].Payload)
+	}
+}
+
+func TestPushLocalizedAlert(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:   "Localized alert",
+			Method: "POST",
+			URL:    "/push",
+			Body: `{"device_key":"` + key + `","title_loc_key":"ORDER_TITLE","title_loc_args":[42],` +
+				`"loc_key":"ORDER_BODY","loc_args":["Alice","coffee"]}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "V1 localized alert",
+			Method:         "GET",
+			URL:            "/" + key + "?subtitle_loc_key=ORDER_SUBTITLE&subtitle_loc_args=a,b",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Arguments without key",
+			Method:         "GET",
+			URL:            "/" + key + "/body?loc_args=a,b",
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	var pl struct {
+		Aps struct {
+			Alert map[string]interface{} `json:"alert"`
+		} `json:"aps"`
+	}
+	if err := json.Unmarshal(notifications[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"title-loc-key":  "ORDER_TITLE",
+		"title-loc-args": []interface{}{"42"},
+		"loc-key":        "ORDER_BODY",
+		"loc-args":       []interface{}{"Alice", "coffee"},
+	}
+	if !reflect.DeepEqual(pl.Aps.Alert, want) {
+		t.Fatalf("unexpected localized alert: %s", notifications[0].Payload)
+	}
+
+	pl.Aps.Alert = nil
+	if err := json.Unmarshal(notifications[1].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{
+		"subtitle-loc-key":  "ORDER_SUBTITLE",
+		"subtitle-loc-args": []interface{}{"a", "b"},
+	}
+	if !reflect.DeepEqual(pl.Aps.Alert, want) {
+		t.Fatalf("unexpected V1 localized alert: %s", notifications[1].Payload)
+	}
+}
+
+func TestLiveActivity(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	const activityToken, startToken = "activity-token", "start-token"
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Update without token",
+			Method:         "POST",
+			URL:            "/live-activity/update",
+			Body:           `{"device_key":"` + key + `","content_state":{"progress":0.5}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+			WantBody:       "no live activity token registered",
+		},
+		{
+			Name:           "Register tokens",
+			Method:         "POST",
+			URL:            "/live-activity/register",
+			Body:           `{"device_key":"` + key + `","activity_token":"` + activityToken + `","start_token":"` + startToken + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:   "Start activity",
+			Method: "POST",
+			URL:    "/live-activity/start",
+			Body: `{"device_key":"` + key + `","attributes_type":"DeployAttributes","attributes":{"name":"api"},` +
+				`"content_state":{"progress":0},"title":"Deploy","body":"Deploy started"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Update activity",
+			Method:         "POST",
+			URL:            "/live-activity/update",
+			Body:           `{"device_key":"` + key + `","content_state":{"progress":0.5},"stale_date":1900000000,"priority":5}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Start without alert",
+			Method:         "POST",
+			URL:            "/live-activity/start",
+			Body:           `{"device_key":"` + key + `","attributes_type":"DeployAttributes","content_state":{}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Unknown event",
+			Method:         "POST",
+			URL:            "/live-activity/pause",
+			Body:           `{"device_key":"` + key + `","content_state":{}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	start, update := notifications[0], notifications[1]
+	if start.DeviceToken != startToken || start.Topic != "me.fin.bark.push-type.liveactivity" || start.PushType != "liveactivity" ||
+		!strings.Contains(string(start.Payload), `"event":"start"`) || !strings.Contains(string(start.Payload), `"attributes-type":"DeployAttributes"`) {
+		t.Fatalf("unexpected start push: %+v", start)
+	}
+	if update.DeviceToken != activityToken || update.Priority != "5" ||
+		!strings.Contains(string(update.Payload), `"stale-date":1900000000`) || !strings.Contains(string(update.Payload), `"content-state":{"progress":0.5}`) {
+		t.Fatalf("unexpected update push: %+v", update)
+	}
+
+	// The token of an ended activity is removed once APNs reports it gone
+	fakeAPNs.Script(activityToken, fakeapns.Response{StatusCode: 410, Reason: "Unregistered"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "End with expired token",
+			Method:         "POST",
+			URL:            "/live-activity/end",
+			Body:           `{"device_key":"` + key + `","content_state":{"progress":1},"dismissal_date":60}`,
+			IsJson:         true,
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "End after token removed",
+			Method:         "POST",
+			URL:            "/live-activity/end",
+			Body:           `{"device_key":"` + key + `","content_state":{"progress":1}}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+	if device, err := db.DeviceByKey(key); err != nil || device.Token != deviceToken || device.ActivityStartToken != startToken {
+		t.Fatalf("unexpected device after activity ended: %+v, %v", device, err)
+	}
+}
+
+func TestSilentPush(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer SetMaxSilentPushPerHour(3)
+
+	SetMaxSilentPushPerHour(2)
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Silent push endpoint",
+			Method:         "POST",
+			URL:            "/push/silent",
+			Body:           `{"device_key":"` + key + `","refresh":"feed","since":1700000000,"badge":2}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Silent push conflicting push type",
+			Method:         "POST",
+			URL:            "/push/silent",
+			Body:           `{"device_key":"` + key + `","push_type":"alert"}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Background push type is not throttled",
+			Method:         "GET",
+			URL:            "/" + key + "?push_type=background&refresh=feed",
+			WantStatusCode: 200,
+		},
+	})
+	// Failed silent pushes don't count towards the limit
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 413, Reason: "PayloadTooLarge"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Silent push failed",
+			Method:         "GET",
+			URL:            "/" + key + "?silent=1",
+			WantStatusCode: 413,
+		},
+		{
+			Name:           "Silent parameter",
+			Method:         "GET",
+			URL:            "/" + key + "?silent=1&refresh=inbox",
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Silent push throttled",
+			Method:         "GET",
+			URL:            "/" + key + "?silent=1",
+			WantStatusCode: 429,
+			WantBody:       "too many silent pushes",
+		},
+		{
+			Name:           "Alerts are not throttled",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 200,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 5 {
+		t.Fatalf("want 5 notifications, got %d", len(notifications))
+	}
+	var pl struct {
+		Aps     map[string]interface{} `json:"aps"`
+		Refresh string                 `json:"refresh"`
+		Since   float64                `json:"since"`
+	}
+	if err := json.Unmarshal(notifications[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if n := notifications[0]; n.PushType != "background" || n.Priority != "5" || pl.Aps["content-available"] != 1.0 ||
+		pl.Aps["alert"] != nil || pl.Aps["badge"] != nil || pl.Aps["sound"] != nil || pl.Refresh != "feed" || pl.Since != 1700000000 {
+		t.Fatalf("unexpected silent push: %+v", n)
+	}
+	if n := notifications[3]; n.PushType != "background" || !strings.Contains(string(n.Payload), `"refresh":"inbox"`) || strings.Contains(string(n.Payload), "silent") {
+		t.Fatalf("unexpected silent push: %+v", n)
+	}
+}
+
+func TestReserveSilentPush(t *testing.T) {
+	defer SetMaxSilentPushPerHour(3)
+
+	SetMaxSilentPushPerHour(2)
+	now := time.Now()
+	var reserved atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, _ := reserveSilentPush(key, now); release != nil {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := reserved.Load(); n != 2 {
+		t.Fatalf("want 2 concurrent silent pushes reserved, got %d", n)
+	}
+
+	// A released slot can be taken again
+	SetMaxSilentPushPerHour(1)
+	release, _ := reserveSilentPush(key, now)
+	if release == nil {
+		t.Fatal("want a silent push slot")
+	}
+	if again, wait := reserveSilentPush(key, now); again != nil || wait != time.Hour {
+		t.Fatalf("want the limit reached, got wait %v", wait)
+	}
+	release()
+	if again, _ := reserveSilentPush(key, now); again == nil {
+		t.Fatal("want the released slot to be taken again")
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer SetDeliveryLogRetention(168 * time.Hour)
+
+	SetDeliveryLogRetention(0)
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Delivery log disabled",
+			Method:         "GET",
+			URL:            "/deliveries/deploy-42?device_key=" + key,
+			WantStatusCode: 501,
+		},
+	})
+
+	SetDeliveryLogRetention(time.Hour)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Push with message id",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_key":"` + key + `","body":"body","id":"deploy-42"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"apns_id":"`,
+		},
+		{
+			Name:           "Batch push returns the apns-id",
+			Method:         "POST",
+			URL:            "/push",
+			Body:           `{"device_keys":["` + key + `"],"body":"body","id":"deploy-42"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"apns_id":"`,
+		},
+		{
+			Name:           "Deliveries of the message id",
+			Method:         "GET",
+			URL:            "/deliveries/deploy-42?device_key=" + key,
+			WantStatusCode: 200,
+			WantBody:       `"id":"deploy-42","device_key":"` + key + `"`,
+		},
+		{
+			Name:           "Deliveries without device key",
+			Method:         "GET",
+			URL:            "/deliveries/deploy-42",
+			WantStatusCode: 400,
+		},
+		{
+			Name:           "Deliveries of another device key",
+			Method:         "GET",
+			URL:            "/deliveries/deploy-42?device_key=otherKey",
+			WantStatusCode: 404,
+		},
+		{
+			Name:           "Unknown message id",
+			Method:         "GET",
+			URL:            "/deliveries/unknown?device_key=" + key,
+			WantStatusCode: 404,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	deliveries, err := db.(database.DeliveryLog).DeliveriesByID("deploy-42")
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("want 2 deliveries, got %v, %v", deliveries, err)
+	}
+	for i, delivery := range deliveries {
+		if delivery.ApnsID != notifications[i].ApnsID || delivery.StatusCode != 200 {
+			t.Fatalf("unexpected delivery: %+v", delivery)
+		}
+	}
+
+	// Pushes without id are logged by apns-id
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 400, Reason: "TopicDisallowed"})
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Rejected push",
+			Method:         "GET",
+			URL:            "/" + key + "/body",
+			WantStatusCode: 500,
+		},
+	})
+	apnsID := fakeAPNs.Notifications()[2].ApnsID
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Deliveries of the apns-id",
+			Method:         "GET",
+			URL:            "/deliveries/" + apnsID + "?device_key=" + key,
+			WantStatusCode: 200,
+			WantBody:       `"status_code":400,"reason":"TopicDisallowed"`,
+		},
+	})
+}
+
+func TestAPNsStats(t *testing.T) {
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "APNs client statistics",
+			Method:         "GET",
+			URL:            "/info/apns",
+			WantStatusCode: 200,
+			WantBody:       `"profile":"default","environment":"production","id":0`,
+		},
+	})
+}
+
 type APITestCase struct {
 	Name           string
 	Method         string
 	URL            string
 	Body           string
 	IsJson         bool
+	Headers        map[string]string
 	WantStatusCode int
+	// Substring the response body must contain
+	WantBody string
 }
 
 func NewServer() *fiber.App {
@@ -302,18 +1220,22 @@ func Endpoint(t *testing.T, tc []APITestCase) {
 			} else {
 				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			}
+			for name, value := range tt.Headers {
+				req.Header.Set(name, value)
+			}
 			res, err := app.Test(req)
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer res.Body.Close()
 
+			body, _ := io.ReadAll(io.Reader(res.Body))
 			if res.StatusCode != tt.WantStatusCode {
-				body, _ := io.ReadAll(io.Reader(res.Body))
 				t.Fatalf("want %d, got %d, res: %s", tt.WantStatusCode, res.StatusCode, string(body))
 			}
+			if !strings.Contains(string(body), tt.WantBody) {
+				t.Fatalf("want body containing %s, got %s", tt.WantBody, string(body))
+			}
 		})
-		// Prevent rate limiting by sending requests too quickly
-		time.Sleep(100 * time.Millisecond)
 	}
 }
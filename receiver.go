@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Query parameters configuring the receivers, they are not push parameters
+var receiverQueryArgs = map[string]bool{
+	"events": true,
+}
+
+// Notification bodies of the receivers are cut to this many characters
+const maxReceiverBodyLength = 256
+
+// receiverPush pushes the parameters mapped from the payload of a webhook receiver to the
+// device key of the route, the query parameters of the receiver URL override the mapped
+// ones, so a receiver can be configured with e.g. ?sound=alarm&group=ops
+func receiverPush(c *fiber.Ctx, params map[string]interface{}) (pushResult, error) {
+	c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+		if name := strings.ToLower(string(key)); !receiverQueryArgs[name] {
+			params[name] = string(value)
+		}
+	})
+	params["device_key"] = c.Params("device_key")
+	return push(params)
+}
+
+// receiverEvents returns the events selected by the comma separated ?events= of the
+// receiver URL, or the default events of the receiver
+func receiverEvents(c *fiber.Ctx, defaults ...string) map[string]bool {
+	names := defaults
+	if events := c.Query("events"); events != "" {
+		names = strings.Split(events, ",")
+	}
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[strings.TrimSpace(name)] = true
+	}
+	return selected
+}
+
+// receiverIgnored responds to an event which is not pushed, webhook senders treat
+// the failed responses as failed deliveries
+func receiverIgnored(c *fiber.Ctx, event string) error {
+	return c.JSON(data(map[string]interface{}{"ignored": true, "event": event}))
+}
+
+// shortText cuts a text to its first paragraph of at most max characters
+func shortText(text string, max int) string {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if i := strings.Index(text, "\n\n"); i >= 0 {
+		text = text[:i]
+	}
+	if runes := []rune(text); len(runes) > max {
+		text = strings.TrimSpace(string(runes[:max-1])) + "…"
+	}
+	return text
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/finb/bark-server/v2/apns/fakeapns"
+	"github.com/finb/bark-server/v2/database"
+)
+
+// readSample reads a captured webhook payload of testdata
+func readSample(t *testing.T, name string) string {
+	bs, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+// notificationPayload decodes the aps dictionary and the custom fields of a notification
+func notificationPayload(t *testing.T, n fakeapns.Notification) (map[string]interface{}, map[string]interface{}) {
+	var pl map[string]interface{}
+	if err := json.Unmarshal(n.Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	aps, _ := pl["aps"].(map[string]interface{})
+	return aps, pl
+}
+
+func TestAlertmanager(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer SetAlertmanagerDedupWindow(alertmanagerDedupWindow)
+
+	SetAlertmanagerDedupWindow(alertmanagerDedupWindow)
+	fakeAPNs.Reset()
+	firing := readSample(t, "alertmanager.json")
+	resolved := strings.ReplaceAll(firing, `"status": "firing"`, `"status": "resolved"`)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Firing alert group",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key + "?sound=alarm",
+			Body:           firing,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Duplicate notification",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key,
+			Body:           firing,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"deduplicated":true`,
+		},
+		{
+			Name:           "Resolved alert group",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key,
+			Body:           resolved,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Empty payload",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key,
+			Body:           `{"status":"firing","alerts":[]}`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	aps, pl := notificationPayload(t, notifications[0])
+	alert, _ := aps["alert"].(map[string]interface{})
+	sound, _ := aps["sound"].(map[string]interface{})
+	if alert["title"] != "[FIRING:2] HighRequestLatency" || alert["subtitle"] != "job=api" ||
+		alert["body"] != "• High request latency on api-1:9090\n• High request latency on api-2:9090" ||
+		aps["thread-id"] != "HighRequestLatency" || aps["interruption-level"] != "critical" || sound["name"] != "alarm.caf" ||
+		pl["url"] != "http://alertmanager:9093" || len(notifications[0].CollapseID) != 32 {
+		t.Fatalf("unexpected firing notification: %+v %s", notifications[0], notifications[0].Payload)
+	}
+	aps, _ = notificationPayload(t, notifications[1])
+	alert, _ = aps["alert"].(map[string]interface{})
+	if alert["title"] != "[RESOLVED] HighRequestLatency" || aps["interruption-level"] == "critical" ||
+		notifications[1].CollapseID != notifications[0].CollapseID {
+		t.Fatalf("unexpected resolved notification: %+v %s", notifications[1], notifications[1].Payload)
+	}
+
+	// A failed push is not recorded, so the retry of Alertmanager is pushed
+	fakeAPNs.Reset()
+	fakeAPNs.Script(deviceToken, fakeapns.Response{StatusCode: 400, Reason: "BadTopic"})
+	retried := strings.Replace(firing, `"groupKey": "{}:`, `"groupKey": "{}/retry:`, 1)
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Failed push",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key,
+			Body:           retried,
+			IsJson:         true,
+			WantStatusCode: 500,
+		},
+		{
+			Name:           "Retried notification",
+			Method:         "POST",
+			URL:            "/webhook/alertmanager/" + key,
+			Body:           retried,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"retries"`,
+		},
+	})
+}
+
+func TestAlertmanagerParams(t *testing.T) {
+	payload := AlertmanagerWebhook{
+		Status:          "firing",
+		TruncatedAlerts: 3,
+		GroupLabels:     map[string]string{"alertname": "DiskFull"},
+		Alerts: []AlertmanagerAlert{
+			{Status: "firing", Labels: map[string]string{"alertname": "DiskFull", "instance": "db-1", "severity": "warning"}},
+			{Status: "resolved", Labels: map[string]string{"alertname": "DiskFull", "instance": "db-2"},
+				Annotations: map[string]string{"description": "Disk of db-2 is 95% full"}, GeneratorURL: "http://prometheus:9090/graph"},
+		},
+	}
+	params := payload.params()
+	if params["title"] != "[FIRING:4] DiskFull" || params["body"] != "• instance=db-1, severity=warning\n• [resolved] Disk of db-2 is 95% full\n… and 3 more" ||
+		params["group"] != "DiskFull" || params["level"] != nil || params["subtitle"] != nil || params["url"] != "http://prometheus:9090/graph" {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+}
+
+func TestGrafanaParams(t *testing.T) {
+	params, err := parseGrafana([]byte(readSample(t, "grafana.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[FIRING:2] High memory usage Infrastructure (blue)" ||
+		params["body"] != "• This alert was triggered for zone us-1\n• This alert was triggered for zone eu-1" ||
+		params["group"] != "High memory usage" || params["level"] != "critical" ||
+		params["url"] != "https://grafana.example.com/d/a1b2c3d4/hosts?orgId=1&viewPanel=12" {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+
+	// Without the rendered title the title is counted like Alertmanager ones
+	params, err = parseGrafana([]byte(`{"status":"resolved","message":"**Resolved**","alerts":[{"status":"resolved","labels":{"alertname":"CPU"},"generatorURL":"https://grafana/rule"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[RESOLVED] Grafana" || params["body"] != "**Resolved**" || params["level"] != nil || params["url"] != "https://grafana/rule" {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+
+	if _, err := parseGrafana([]byte(`{"status":"firing","alerts":[]}`)); err == nil {
+		t.Fatal("want an error for a payload without alerts")
+	}
+}
+
+func TestUptimeKumaParams(t *testing.T) {
+	params, err := parseUptimeKuma([]byte(readSample(t, "uptime-kuma.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[Down] Public API" || params["body"] != "connect ECONNREFUSED 10.0.0.12:443" ||
+		params["group"] != "Uptime Kuma" || params["level"] != "timeSensitive" || params["url"] != "https://api.example.com/health" {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+
+	// The test notification has only a message
+	params, err = parseUptimeKuma([]byte(`{"heartbeat":null,"monitor":null,"msg":"Bark Testing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "Uptime Kuma" || params["body"] != "Bark Testing" || params["level"] != nil || params["url"] != nil {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+
+	if _, err := parseUptimeKuma([]byte(`{}`)); err == nil {
+		t.Fatal("want an error for an empty payload")
+	}
+}
+
+func TestNetdataParams(t *testing.T) {
+	params, err := parseNetdata([]byte(readSample(t, "netdata.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "Critical alert on web-1: 10min_cpu_usage = 96.4%" ||
+		params["body"] != "Average CPU utilization over the last 10 minutes (excluding iowait, nice and steal)\nAlso active: 1 critical, 3 warning" ||
+		params["subtitle"] != "Production / All nodes" || params["group"] != "Netdata" || params["level"] != "critical" ||
+		params["url"] != "https://app.netdata.cloud/spaces/production/rooms/all-nodes/alerts/10min_cpu_usage" {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+
+	params, err = parseNetdata([]byte(`{"alarm":"disk_space_usage","info":"Disk space utilization","severity":"clear"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[CLEAR] disk_space_usage" || params["body"] != "Disk space utilization" || params["level"] != "active" || params["subtitle"] != nil {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+}
+
+func TestMonitoringReceivers(t *testing.T) {
+	defer fakeAPNs.Reset()
+
+	fakeAPNs.Reset()
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "Grafana",
+			Method:         "POST",
+			URL:            "/webhook/grafana/" + key,
+			Body:           readSample(t, "grafana.json"),
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Uptime Kuma",
+			Method:         "POST",
+			URL:            "/webhook/uptime-kuma/" + key + "?group=uptime",
+			Body:           readSample(t, "uptime-kuma.json"),
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Netdata",
+			Method:         "POST",
+			URL:            "/webhook/netdata/" + key,
+			Body:           readSample(t, "netdata.json"),
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalid payload",
+			Method:         "POST",
+			URL:            "/webhook/netdata/" + key,
+			Body:           `{"message":`,
+			IsJson:         true,
+			WantStatusCode: 400,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 3 {
+		t.Fatalf("want 3 notifications, got %d", len(notifications))
+	}
+	aps, pl := notificationPayload(t, notifications[0])
+	alert, _ := aps["alert"].(map[string]interface{})
+	if alert["title"] != "[FIRING:2] High memory usage Infrastructure (blue)" || aps["interruption-level"] != "critical" ||
+		pl["url"] != "https://grafana.example.com/d/a1b2c3d4/hosts?orgId=1&viewPanel=12" {
+		t.Fatalf("unexpected grafana notification: %s", notifications[0].Payload)
+	}
+	aps, _ = notificationPayload(t, notifications[1])
+	if aps["thread-id"] != "uptime" || aps["interruption-level"] != "time-sensitive" {
+		t.Fatalf("unexpected uptime kuma notification: %s", notifications[1].Payload)
+	}
+	aps, pl = notificationPayload(t, notifications[2])
+	alert, _ = aps["alert"].(map[string]interface{})
+	if alert["subtitle"] != "Production / All nodes" || pl["url"] == nil {
+		t.Fatalf("unexpected netdata notification: %s", notifications[2].Payload)
+	}
+}
+
+// githubSignature signs a webhook body like GitHub
+func githubSignature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestGitHubParams(t *testing.T) {
+	params, err := parseGitHub("workflow_run", []byte(readSample(t, "github-workflow-run.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[Finb/bark-server] CI #412 failed" || params["body"] != "Fix the retry of webhook deliveries\non main" ||
+		params["group"] != "Finb/bark-server" || params["level"] != "timeSensitive" ||
+		params["url"] != "https://github.com/Finb/bark-server/actions/runs/9061326587" {
+		t.Fatalf("unexpected workflow_run params: %+v", params)
+	}
+
+	params, err = parseGitHub("pull_request_review", []byte(readSample(t, "github-pull-request-review.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[Finb/bark-server] PR #218 approved by hubot" ||
+		params["body"] != "Retry webhook deliveries with backoff\nLooks good, one nit on the retry backoff." ||
+		params["url"] != "https://github.com/Finb/bark-server/pull/218#pullrequestreview-2052312345" || params["level"] != nil {
+		t.Fatalf("unexpected pull_request_review params: %+v", params)
+	}
+
+	params, err = parseGitHub("release", []byte(readSample(t, "github-release.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[Finb/bark-server] Release v2.2.0" ||
+		params["body"] != "v2.2.0 Webhook receivers\nReceivers for Alertmanager, Grafana, GitHub and GitLab webhooks." ||
+		params["url"] != "https://github.com/Finb/bark-server/releases/tag/v2.2.0" {
+		t.Fatalf("unexpected release params: %+v", params)
+	}
+
+	// Successful runs and other actions are not pushed
+	succeeded := strings.Replace(readSample(t, "github-workflow-run.json"), `"conclusion": "failure"`, `"conclusion": "success"`, 1)
+	if params, err := parseGitHub("workflow_run", []byte(succeeded)); err != nil || params != nil {
+		t.Fatalf("successful run was pushed: %+v %v", params, err)
+	}
+	requested := strings.Replace(readSample(t, "github-release.json"), `"action": "published"`, `"action": "created"`, 1)
+	if params, err := parseGitHub("release", []byte(requested)); err != nil || params != nil {
+		t.Fatalf("created release was pushed: %+v %v", params, err)
+	}
+}
+
+func TestGitLabParams(t *testing.T) {
+	params, err := parseGitLab([]byte(readSample(t, "gitlab-pipeline.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[ops/bark-server] Pipeline #1287 failed" || params["body"] != "Update the APNs certificate\non main" ||
+		params["group"] != "ops/bark-server" || params["level"] != "timeSensitive" ||
+		params["url"] != "https://gitlab.example.com/ops/bark-server/-/pipelines/1287" {
+		t.Fatalf("unexpected pipeline params: %+v", params)
+	}
+
+	// Older GitLab versions don't send the pipeline URL
+	params, err = parseGitLab([]byte(strings.Replace(readSample(t, "gitlab-pipeline.json"), `"url": "https://gitlab.example.com/ops/bark-server/-/pipelines/1287"`, `"url": ""`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["url"] != "https://gitlab.example.com/ops/bark-server/-/pipelines/1287" {
+		t.Fatalf("unexpected pipeline url: %+v", params)
+	}
+
+	params, err = parseGitLab([]byte(readSample(t, "gitlab-merge-request.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[ops/bark-server] MR !57 approved by jane" || params["body"] != "Deliver pushes to Android devices with FCM" ||
+		params["url"] != "https://gitlab.example.com/ops/bark-server/-/merge_requests/57" {
+		t.Fatalf("unexpected merge_request params: %+v", params)
+	}
+
+	params, err = parseGitLab([]byte(`{"object_kind":"release","action":"create","tag":"v1.0.0","name":"v1.0.0","description":"First release",` +
+		`"url":"https://gitlab.example.com/ops/bark-server/-/releases/v1.0.0","project":{"path_with_namespace":"ops/bark-server"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "[ops/bark-server] Release v1.0.0" || params["body"] != "First release" ||
+		params["url"] != "https://gitlab.example.com/ops/bark-server/-/releases/v1.0.0" {
+		t.Fatalf("unexpected release params: %+v", params)
+	}
+
+	running := strings.Replace(readSample(t, "gitlab-pipeline.json"), `"status": "failed"`, `"status": "running"`, 1)
+	if params, err := parseGitLab([]byte(running)); err != nil || params != nil {
+		t.Fatalf("running pipeline was pushed: %+v %v", params, err)
+	}
+}
+
+func TestRepositoryReceivers(t *testing.T) {
+	defer fakeAPNs.Reset()
+	defer db.SaveDevice(key, &database.Device{Token: deviceToken})
+
+	fakeAPNs.Reset()
+	workflowRun := readSample(t, "github-workflow-run.json")
+	pipeline := readSample(t, "gitlab-pipeline.json")
+	Endpoint(t, []APITestCase{
+		{
+			Name:           "No receiver secret",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key,
+			Body:           workflowRun,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "workflow_run", "X-Hub-Signature-256": githubSignature("", workflowRun)},
+			WantStatusCode: 403,
+		},
+		{
+			Name:           "Register receiver secret",
+			Method:         "POST",
+			URL:            "/receiver-secret/register",
+			Body:           `{"device_key":"` + key + `","secret":"s3cret"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"secret":"s3cret"`,
+		},
+		{
+			Name:           "Replace receiver secret without the current one",
+			Method:         "POST",
+			URL:            "/receiver-secret/register",
+			Body:           `{"device_key":"` + key + `","secret":"stolen"}`,
+			IsJson:         true,
+			WantStatusCode: 403,
+		},
+		{
+			Name:           "Replace receiver secret with a wrong one",
+			Method:         "POST",
+			URL:            "/receiver-secret/register",
+			Body:           `{"device_key":"` + key + `","secret":"stolen","current_secret":"wrong"}`,
+			IsJson:         true,
+			WantStatusCode: 403,
+		},
+		{
+			Name:           "Replace receiver secret",
+			Method:         "POST",
+			URL:            "/receiver-secret/register",
+			Body:           `{"device_key":"` + key + `","secret":"s3cret","current_secret":"s3cret"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+			WantBody:       `"secret":"s3cret"`,
+		},
+		{
+			Name:           "Register again keeps the secret",
+			Method:         "POST",
+			URL:            "/register",
+			Body:           `{"device_key":"` + key + `","device_token":"` + deviceToken + `"}`,
+			IsJson:         true,
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "Invalid GitHub signature",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key,
+			Body:           workflowRun,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "workflow_run", "X-Hub-Signature-256": githubSignature("wrong", workflowRun)},
+			WantStatusCode: 401,
+		},
+		{
+			Name:           "Unsigned GitHub event",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key,
+			Body:           workflowRun,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "workflow_run"},
+			WantStatusCode: 401,
+		},
+		{
+			Name:           "GitHub ping",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key,
+			Body:           `{"zen":"Keep it logically awesome."}`,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": githubSignature("s3cret", `{"zen":"Keep it logically awesome."}`)},
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "GitHub workflow failure",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key + "?sound=alarm",
+			Body:           workflowRun,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "workflow_run", "X-Hub-Signature-256": githubSignature("s3cret", workflowRun)},
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "GitHub event not selected",
+			Method:         "POST",
+			URL:            "/webhook/github/" + key + "?events=release",
+			Body:           workflowRun,
+			IsJson:         true,
+			Headers:        map[string]string{"X-GitHub-Event": "workflow_run", "X-Hub-Signature-256": githubSignature("s3cret", workflowRun)},
+			WantStatusCode: 200,
+			WantBody:       `"ignored":true`,
+		},
+		{
+			Name:           "Invalid GitLab token",
+			Method:         "POST",
+			URL:            "/webhook/gitlab/" + key,
+			Body:           pipeline,
+			IsJson:         true,
+			Headers:        map[string]string{"X-Gitlab-Event": "Pipeline Hook", "X-Gitlab-Token": "wrong"},
+			WantStatusCode: 401,
+		},
+		{
+			Name:           "GitLab pipeline failure",
+			Method:         "POST",
+			URL:            "/webhook/gitlab/" + key,
+			Body:           pipeline,
+			IsJson:         true,
+			Headers:        map[string]string{"X-Gitlab-Event": "Pipeline Hook", "X-Gitlab-Token": "s3cret"},
+			WantStatusCode: 200,
+		},
+		{
+			Name:           "GitLab push event",
+			Method:         "POST",
+			URL:            "/webhook/gitlab/" + key,
+			Body:           `{"object_kind":"push"}`,
+			IsJson:         true,
+			Headers:        map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cret"},
+			WantStatusCode: 200,
+			WantBody:       `"ignored":true`,
+		},
+	})
+
+	notifications := fakeAPNs.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("want 2 notifications, got %d", len(notifications))
+	}
+	aps, pl := notificationPayload(t, notifications[0])
+	alert, _ := aps["alert"].(map[string]interface{})
+	if alert["title"] != "[Finb/bark-server] CI #412 failed" || aps["sound"] != "alarm.caf" || pl["events"] != nil ||
+		pl["url"] != "https://github.com/Finb/bark-server/actions/runs/9061326587" {
+		t.Fatalf("unexpected github notification: %s", notifications[0].Payload)
+	}
+	aps, pl = notificationPayload(t, notifications[1])
+	alert, _ = aps["alert"].(map[string]interface{})
+	if alert["title"] != "[ops/bark-server] Pipeline #1287 failed" || pl["url"] != "https://gitlab.example.com/ops/bark-server/-/pipelines/1287" {
+		t.Fatalf("unexpected gitlab notification: %s", notifications[1].Payload)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/mritd/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// certReloader serves the server TLS certificate, which is reloaded from its files on demand
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// serverCert is nil unless the server listens with TLS
+var serverCert *certReloader
+
+// reloadLock serializes the reloads triggered by signals and the admin endpoint
+var reloadLock sync.Mutex
+
+// reloadFunc reloads the key material, set when the server starts
+var reloadFunc func() error
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: cannot load TLS key pair from certFile=%q and keyFile=%q: %w", r.certFile, r.keyFile, err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reloadKeyMaterial reloads the APNs and FCM credentials, the VAPID key, the server TLS certificate and the MySQL TLS material,
+// in-flight requests keep using the previous material
+func reloadKeyMaterial(c *cli.Context) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	var errs []error
+	if err := setupAPNS(c); err != nil {
+		errs = append(errs, fmt.Errorf("failed to reload apns credentials: %v", err))
+	}
+	if err := setupFCM(c); err != nil {
+		errs = append(errs, fmt.Errorf("failed to reload fcm credentials: %v", err))
+	}
+	if err := setupWebPush(c); err != nil {
+		errs = append(errs, fmt.Errorf("failed to reload web push key: %v", err))
+	}
+	if serverCert != nil {
+		if err := serverCert.reload(); err != nil {
+			errs = append(errs, err)
+		} else {
+			logger.Info("server TLS certificate reloaded")
+		}
+	}
+	if reloader, ok := db.(database.Reloader); ok {
+		if err := reloader.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload database TLS material: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setupReload reloads the key material when the server receives a SIGHUP
+func setupReload(c *cli.Context) {
+	reloadFunc = func() error { return reloadKeyMaterial(c) }
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			logger.Info("Received a SIGHUP signal, reloading key material...")
+			if err := reloadFunc(); err != nil {
+				logger.Errorf("Reload error: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/finb/bark-server/v2/apns"
+	"github.com/urfave/cli/v2"
+)
+
+// newCLIContext returns the context of the server started with the arguments
+func newCLIContext(t *testing.T, args ...string) *cli.Context {
+	flags := getAppFlags()
+	set := flag.NewFlagSet("bark-server", flag.ContinueOnError)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(&cli.App{Flags: flags}, set, nil)
+}
+
+// TestReloadDuringPushes reloads the key material with pushes in flight, run with -race
+func TestReloadDuringPushes(t *testing.T) {
+	defer fakeAPNs.Reset()
+	c := newCLIContext(t,
+		"--data", t.TempDir(),
+		"--apns-host", fakeAPNsURL,
+		"--apns-retry-backoff", "1ms",
+		"--apns-payload-mode", "reject",
+	)
+	reloadFunc = func() error { return reloadKeyMaterial(c) }
+	basicAuthEnabled = true
+	t.Cleanup(func() {
+		reloadFunc, basicAuthEnabled = nil, false
+		setNotifier(PlatformWeb, nil)
+		if err := apns.ReCreateAPNS(fakeAPNsConfig()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				resp, err := app.Test(httptest.NewRequest("GET", "/"+key+"/title/body", nil), -1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				codes <- resp.StatusCode
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		Endpoint(t, []APITestCase{
+			{
+				Name:           "Reload during pushes",
+				Method:         "POST",
+				URL:            "/admin/reload",
+				WantStatusCode: 200,
+			},
+		})
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != 200 {
+			t.Fatalf("push failed during reload: %d", code)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+func init() {
+	registerRoute("admin", func(router fiber.Router) {
+		// reload func reloads the APNs credentials and the TLS material like a SIGHUP,
+		// it is only available when basic auth is enabled
+		router.Post("/admin/reload", func(c *fiber.Ctx) error {
+			if !basicAuthEnabled {
+				return c.Status(403).JSON(failed(403, "admin endpoints require basic auth"))
+			}
+			if reloadFunc == nil {
+				return c.Status(503).JSON(failed(503, "server is not started"))
+			}
+
+			logger.Info("Received a reload request, reloading key material...")
+			if err := reloadFunc(); err != nil {
+				logger.Errorf("Reload error: %v", err)
+				return c.Status(500).JSON(failed(500, "reload failed: %v", err))
+			}
+			return c.JSON(success())
+		})
+	})
+}
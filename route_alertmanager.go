@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AlertmanagerWebhook is the payload of the Alertmanager webhook receiver, version 4
+type AlertmanagerWebhook struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	TruncatedAlerts   int                 `json:"truncatedAlerts"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []AlertmanagerAlert `json:"alerts"`
+}
+
+type AlertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// Alerts listed in the body of a push, the others are counted
+const maxAlertmanagerAlerts = 5
+
+// Alertmanager sends a notification again when it failed, and every replica of an HA
+// cluster may send the same one, identical notifications of a group within the window
+// are pushed once, 0 disables the deduplication
+var alertmanagerDedupWindow = 10 * time.Minute
+
+// alertGroups records the last notification of each alert group by device key
+var alertGroups = struct {
+	sync.Mutex
+	seen map[string]alertGroupNotification
+}{seen: make(map[string]alertGroupNotification)}
+
+type alertGroupNotification struct {
+	signature string
+	at        time.Time
+}
+
+func init() {
+	registerRoute("alertmanager", func(router fiber.Router) {
+		router.Post("/webhook/alertmanager/:device_key", routeDoAlertmanager)
+	})
+}
+
+// Set the window of the Alertmanager notification deduplication, the recorded notifications are cleared
+func SetAlertmanagerDedupWindow(window time.Duration) {
+	alertGroups.Lock()
+	defer alertGroups.Unlock()
+	alertmanagerDedupWindow = window
+	alertGroups.seen = make(map[string]alertGroupNotification)
+}
+
+func routeDoAlertmanager(c *fiber.Ctx) error {
+	var payload AlertmanagerWebhook
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if payload.Status == "" || len(payload.Alerts) == 0 {
+		return c.Status(400).JSON(failed(400, "invalid alertmanager payload: no alerts"))
+	}
+
+	groupKey := c.Params("device_key") + "\x00" + payload.GroupKey
+	signature := payload.signature()
+	if !claimAlertGroup(groupKey, signature, time.Now()) {
+		return c.JSON(data(map[string]bool{"deduplicated": true}))
+	}
+	result, err := receiverPush(c, payload.params())
+	if err != nil {
+		// The notification is pushed again when Alertmanager retries it
+		releaseAlertGroup(groupKey, signature)
+	}
+	return pushResponse(c, result, err)
+}
+
+// claimAlertGroup records the notification of the group, it returns false when the
+// same notification was recorded within the dedup window
+func claimAlertGroup(groupKey, signature string, now time.Time) bool {
+	alertGroups.Lock()
+	defer alertGroups.Unlock()
+	if alertmanagerDedupWindow <= 0 {
+		return true
+	}
+	if last, ok := alertGroups.seen[groupKey]; ok && last.signature == signature && now.Sub(last.at) < alertmanagerDedupWindow {
+		return false
+	}
+	alertGroups.seen[groupKey] = alertGroupNotification{signature: signature, at: now}
+
+	// Forget the groups without recent notifications once in a while
+	if len(alertGroups.seen) > 1024 {
+		for key, last := range alertGroups.seen {
+			if now.Sub(last.at) >= alertmanagerDedupWindow {
+				delete(alertGroups.seen, key)
+			}
+		}
+	}
+	return true
+}
+
+// releaseAlertGroup forgets a notification which could not be pushed
+func releaseAlertGroup(groupKey, signature string) {
+	alertGroups.Lock()
+	defer alertGroups.Unlock()
+	if last, ok := alertGroups.seen[groupKey]; ok && last.signature == signature {
+		delete(alertGroups.seen, groupKey)
+	}
+}
+
+// signature identifies a notification by its status and the status of its alerts
+func (p *AlertmanagerWebhook) signature() string {
+	alerts := make([]string, 0, len(p.Alerts))
+	for _, alert := range p.Alerts {
+		id := alert.Fingerprint
+		if id == "" {
+			id = labelString(alert.Labels, "")
+		}
+		alerts = append(alerts, id+"="+alert.Status)
+	}
+	sort.Strings(alerts)
+	h := sha256.Sum256([]byte(p.Status + "\n" + strings.Join(alerts, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// params maps the alert group to the push parameters
+func (p *AlertmanagerWebhook) params() map[string]interface{} {
+	alertname := p.GroupLabels["alertname"]
+	if alertname == "" {
+		alertname = p.CommonLabels["alertname"]
+	}
+	if alertname == "" {
+		alertname = p.Alerts[0].Labels["alertname"]
+	}
+
+	params := map[string]interface{}{
+		"title": alertGroupTitle(p.Status, p.Alerts, p.TruncatedAlerts, alertname),
+		"body":  alertGroupBody(p.Status, p.Alerts, p.TruncatedAlerts),
+		"group": alertname,
+		// The resolved notification replaces the firing one of the group
+		"collapse_id": groupCollapseID(p.GroupKey),
+	}
+	if subtitle := labelString(p.GroupLabels, "alertname"); subtitle != "" {
+		params["subtitle"] = subtitle
+	}
+	if p.Status == "firing" && hasCriticalAlert(p.Alerts) {
+		params["level"] = "critical"
+	}
+	// The Alertmanager UI of the group, or the Prometheus graph of the alerts
+	if p.ExternalURL != "" {
+		params["url"] = p.ExternalURL
+	} else {
+		for _, alert := range p.Alerts {
+			if alert.GeneratorURL != "" {
+				params["url"] = alert.GeneratorURL
+				break
+			}
+		}
+	}
+	return params
+}
+
+// alertGroupTitle counts the firing alerts of a group, the truncated alerts are firing ones
+func alertGroupTitle(status string, alerts []AlertmanagerAlert, truncated int, name string) string {
+	if status != "firing" {
+		return "[RESOLVED] " + name
+	}
+	firing := truncated
+	for _, alert := range alerts {
+		if alert.Status == "firing" {
+			firing++
+		}
+	}
+	return fmt.Sprintf("[FIRING:%d] %s", firing, name)
+}
+
+// alertGroupBody lists the alerts of a group, the alerts whose status differs from the group are marked
+func alertGroupBody(status string, alerts []AlertmanagerAlert, truncated int) string {
+	var lines []string
+	for _, alert := range alerts {
+		line := alertSummary(alert)
+		if alert.Status != status {
+			line = "[" + alert.Status + "] " + line
+		}
+		if len(alerts) > 1 {
+			line = "• " + line
+		}
+		lines = append(lines, line)
+	}
+	hidden := truncated
+	if len(lines) > maxAlertmanagerAlerts {
+		hidden += len(lines) - maxAlertmanagerAlerts
+		lines = lines[:maxAlertmanagerAlerts]
+	}
+	if hidden > 0 {
+		lines = append(lines, fmt.Sprintf("… and %d more", hidden))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hasCriticalAlert reports whether a firing alert has the label severity=critical
+func hasCriticalAlert(alerts []AlertmanagerAlert) bool {
+	for _, alert := range alerts {
+		if alert.Status == "firing" && alert.Labels["severity"] == "critical" {
+			return true
+		}
+	}
+	return false
+}
+
+// alertSummary describes an alert by its annotations, or its labels without annotations
+func alertSummary(alert AlertmanagerAlert) string {
+	for _, key := range []string{"summary", "description", "message"} {
+		if v := alert.Annotations[key]; v != "" {
+			return v
+		}
+	}
+	return labelString(alert.Labels, "alertname")
+}
+
+// labelString formats the labels sorted by name, without the excluded label
+func labelString(labels map[string]string, exclude string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != exclude {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+labels[name])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// groupCollapseID derives an APNs collapse id, at most 64 bytes, from a group key
+func groupCollapseID(groupKey string) string {
+	h := sha256.Sum256([]byte(groupKey))
+	return hex.EncodeToString(h[:16])
+}
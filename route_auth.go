@@ -9,6 +9,9 @@ import (
 	"github.com/mritd/logger"
 )
 
+// basicAuthEnabled reports whether the routes are protected by basic auth
+var basicAuthEnabled bool
+
 func routerAuth(user, passwd string, router fiber.Router, urlPrefix string) {
 	if user == "" && passwd == "" {
 		logger.Info("Bark Server Has No Basic Auth.")
@@ -16,6 +19,7 @@ func routerAuth(user, passwd string, router fiber.Router, urlPrefix string) {
 	}
 
 	logger.Info("Bark Server Has Basic Auth Enabled.")
+	basicAuthEnabled = true
 	authFreeRouters := []string{"/ping", "/register", "/healthz"}
 	basicAuth := fiberbasicauth.New(fiberbasicauth.Config{
 		Users: map[string]string{user: passwd},
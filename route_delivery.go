@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+// How long the deliveries are kept in the delivery log, 0 disables the log
+var deliveryLogRetention = 168 * time.Hour
+
+// The log is pruned at most once per interval
+const deliveryPruneInterval = time.Hour
+
+var deliveryPrune = struct {
+	sync.Mutex
+	last time.Time
+}{}
+
+// Set how long the deliveries are kept in the delivery log
+func SetDeliveryLogRetention(retention time.Duration) {
+	deliveryLogRetention = retention
+}
+
+func init() {
+	registerRoute("delivery", func(router fiber.Router) {
+		router.Get("/deliveries/:id", routeDoDeliveries)
+	})
+}
+
+// routeDoDeliveries returns the logged deliveries of a message id, the apns-id of pushes sent without id,
+// to the device key given with ?device_key=, so only the owner of a key can look up its deliveries
+func routeDoDeliveries(c *fiber.Ctx) error {
+	log, ok := db.(database.DeliveryLog)
+	if !ok || deliveryLogRetention <= 0 {
+		return c.Status(501).JSON(failed(501, "delivery log is not enabled"))
+	}
+	deviceKey := c.Query("device_key")
+	if deviceKey == "" {
+		return c.Status(400).JSON(failed(400, "device key is empty"))
+	}
+	logged, err := log.DeliveriesByID(c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(failed(500, "failed to get deliveries: %v", err))
+	}
+	deliveries := make([]*database.Delivery, 0, len(logged))
+	for _, delivery := range logged {
+		if delivery.DeviceKey == deviceKey {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	if len(deliveries) == 0 {
+		return c.Status(404).JSON(failed(404, "no delivery of message %s", c.Params("id")))
+	}
+	return c.JSON(data(deliveries))
+}
+
+// logDelivery appends a push answered by APNs to the delivery log
+func logDelivery(id, deviceKey string, res *DeliveryResult) {
+	log, ok := db.(database.DeliveryLog)
+	if !ok || deliveryLogRetention <= 0 || res.ApnsID == "" {
+		return
+	}
+	if id == "" {
+		id = res.ApnsID
+	}
+	now := time.Now()
+	err := log.SaveDelivery(&database.Delivery{
+		ID:           id,
+		DeviceKey:    deviceKey,
+		ApnsID:       res.ApnsID,
+		ApnsUniqueID: res.ApnsUniqueID,
+		StatusCode:   res.StatusCode,
+		Reason:       res.Reason,
+		Retries:      res.Retries,
+		CreatedAt:    now.Unix(),
+	})
+	if err != nil {
+		logger.Errorf("failed to log delivery %s: %v", id, err)
+		return
+	}
+
+	deliveryPrune.Lock()
+	defer deliveryPrune.Unlock()
+	if now.Sub(deliveryPrune.last) < deliveryPruneInterval {
+		return
+	}
+	deliveryPrune.last = now
+	go func() {
+		if err := log.PruneDeliveries(now.Add(-deliveryLogRetention)); err != nil {
+			logger.Errorf("failed to prune delivery log: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/email"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+	"github.com/sideshow/apns2"
+	"github.com/urfave/cli/v2"
+)
+
+// fallbackResult reports the email sent instead of an undeliverable push
+type fallbackResult struct {
+	Channel string `json:"channel"`
+	// Why the push was not delivered to the device
+	Reason string `json:"reason"`
+	Sent   bool   `json:"sent"`
+	Error  string `json:"error,omitempty"`
+}
+
+type FallbackEmailInfo struct {
+	DeviceKey string `form:"device_key,omitempty" json:"device_key,omitempty" xml:"device_key,omitempty" query:"device_key,omitempty"`
+	// Empty removes the fallback email of the device
+	Email string `form:"email,omitempty" json:"email,omitempty" xml:"email,omitempty" query:"email,omitempty"`
+}
+
+var emailSenderLock sync.RWMutex
+var emailSender *email.Sender
+
+var fallbackEmailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html><body style="font-family: -apple-system, sans-serif">
+{{if .Title}}<h3>{{.Title}}</h3>{{end}}
+{{if .Subtitle}}<p><strong>{{.Subtitle}}</strong></p>{{end}}
+<p style="white-space: pre-wrap">{{.Body}}</p>
+{{if .URL}}<p><a href="{{.URL}}">{{.URL}}</a></p>{{end}}
+</body></html>
+`))
+
+func init() {
+	registerRoute("fallback_email", func(router fiber.Router) {
+		router.Post("/fallback-email/register", routeDoRegisterFallbackEmail)
+	})
+}
+
+// setupEmailFallback enables the fallback emails when an SMTP server is configured
+func setupEmailFallback(c *cli.Context) error {
+	var sender *email.Sender
+	if host := c.String("smtp-host"); host != "" {
+		var err error
+		sender, err = email.NewSender(email.Config{
+			Host:     host,
+			Port:     c.Int("smtp-port"),
+			Username: c.String("smtp-username"),
+			Password: c.String("smtp-password"),
+			From:     c.String("smtp-from"),
+			TLS:      c.String("smtp-tls"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	setEmailSender(sender)
+	return nil
+}
+
+// setEmailSender sets the sender of the fallback emails, nil disables them
+func setEmailSender(sender *email.Sender) {
+	emailSenderLock.Lock()
+	emailSender = sender
+	emailSenderLock.Unlock()
+}
+
+// routeDoRegisterFallbackEmail sets the fallback email of a device key, the server then sends
+// the pushes to the address, so it is only available to the basic auth users
+func routeDoRegisterFallbackEmail(c *fiber.Ctx) error {
+	if !basicAuthEnabled {
+		return c.Status(403).JSON(failed(403, "fallback emails require basic auth"))
+	}
+
+	var info FallbackEmailInfo
+	if err := c.BodyParser(&info); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if info.DeviceKey == "" {
+		return c.Status(400).JSON(failed(400, "device key is empty"))
+	}
+	if info.Email != "" {
+		if err := email.ValidateAddress(info.Email); err != nil {
+			return c.Status(400).JSON(failed(400, "%s", err.Error()))
+		}
+	}
+
+	device, err := db.DeviceByKey(info.DeviceKey)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "failed to get device: %v", err))
+	}
+	device.FallbackEmail = info.Email
+	if _, err := db.SaveDevice(info.DeviceKey, device); err != nil {
+		logger.Errorf("fallback email registration failed: %v", err)
+		return c.Status(500).JSON(failed(500, "fallback email registration failed: %v", err))
+	}
+	return c.JSON(success())
+}
+
+// emailFallback sends the message to the fallback email of the device when the push failed,
+// the push succeeds when the email was sent, the result reports the fallback either way
+func emailFallback(msg *Message, device *database.Device, result pushResult, pushErr error) (pushResult, error) {
+	emailSenderLock.RLock()
+	sender := emailSender
+	emailSenderLock.RUnlock()
+
+	// Silent pushes and encrypted messages are not readable as an email
+	if sender == nil || device.FallbackEmail == "" || msg.Silent || msg.Params["ciphertext"] != nil {
+		return result, pushErr
+	}
+	// A token rejected as bad before any delivery was never a device
+	if device.InvalidReason == apns2.ReasonBadDeviceToken && device.DeliveredAt == 0 {
+		return result, pushErr
+	}
+
+	result.Fallback = &fallbackResult{Channel: "email", Reason: pushErr.Error()}
+	if err := sender.Send(fallbackEmail(msg, device.FallbackEmail)); err != nil {
+		logger.Warnf("fallback email of %s failed: %v", msg.DeviceKey, err)
+		result.Fallback.Error = err.Error()
+		return result, pushErr
+	}
+	result.Fallback.Sent = true
+	result.Code = 200
+	return result, nil
+}
+
+// fallbackEmail renders the push message as a plain-text and HTML email
+func fallbackEmail(msg *Message, to string) *email.Message {
+	url, _ := msg.Params["url"].(string)
+	subject := msg.Title
+	if subject == "" {
+		subject = "Bark"
+	}
+	if group, _ := msg.Params["group"].(string); group != "" {
+		subject = fmt.Sprintf("[%s] %s", group, subject)
+	}
+
+	var text []string
+	for _, line := range []string{msg.Title, msg.Subtitle, msg.Body, url} {
+		if line != "" {
+			text = append(text, line)
+		}
+	}
+	var html bytes.Buffer
+	_ = fallbackEmailTemplate.Execute(&html, map[string]string{
+		"Title":    msg.Title,
+		"Subtitle": msg.Subtitle,
+		"Body":     msg.Body,
+		"URL":      url,
+	})
+	return &email.Message{
+		To:      to,
+		Subject: subject,
+		Text:    strings.Join(text, "\n\n") + "\n",
+		HTML:    html.String(),
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/finb/bark-server/v2/apns"
+	"github.com/finb/bark-server/v2/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+// Live Activity push tokens are longer than device tokens
+const maxActivityTokenLength = 255
+
+type LiveActivityInfo struct {
+	DeviceKey string `form:"device_key,omitempty" json:"device_key,omitempty" xml:"device_key,omitempty" query:"device_key,omitempty"`
+	// Push token of the running activity, used by update and end
+	ActivityToken string `form:"activity_token,omitempty" json:"activity_token,omitempty" xml:"activity_token,omitempty" query:"activity_token,omitempty"`
+	// Push-to-start token, used by start
+	StartToken string `form:"start_token,omitempty" json:"start_token,omitempty" xml:"start_token,omitempty" query:"start_token,omitempty"`
+}
+
+type LiveActivityRequest struct {
+	DeviceKey      string                 `json:"device_key,omitempty"`
+	ContentState   map[string]interface{} `json:"content_state,omitempty"`
+	AttributesType string                 `json:"attributes_type,omitempty"`
+	Attributes     map[string]interface{} `json:"attributes,omitempty"`
+	// Seconds from now, a unix timestamp or an RFC3339 date
+	StaleDate     interface{} `json:"stale_date,omitempty"`
+	DismissalDate interface{} `json:"dismissal_date,omitempty"`
+	Title         string      `json:"title,omitempty"`
+	Body          string      `json:"body,omitempty"`
+	Sound         string      `json:"sound,omitempty"`
+	Priority      int         `json:"priority,omitempty"`
+}
+
+func init() {
+	registerRoute("live_activity", func(router fiber.Router) {
+		router.Post("/live-activity/register", routeDoRegisterLiveActivity)
+		router.Post("/live-activity/:event", routeDoPushLiveActivity)
+	})
+}
+
+func routeDoRegisterLiveActivity(c *fiber.Ctx) error {
+	var info LiveActivityInfo
+	if err := c.BodyParser(&info); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if info.DeviceKey == "" {
+		return c.Status(400).JSON(failed(400, "device key is empty"))
+	}
+	if info.ActivityToken == "" && info.StartToken == "" {
+		return c.Status(400).JSON(failed(400, "activity token is empty"))
+	}
+	if len(info.ActivityToken) > maxActivityTokenLength || len(info.StartToken) > maxActivityTokenLength {
+		return c.Status(400).JSON(failed(400, "activity token is invalid"))
+	}
+
+	device, err := db.DeviceByKey(info.DeviceKey)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "failed to get device: %v", err))
+	}
+	if info.ActivityToken != "" {
+		device.ActivityToken = info.ActivityToken
+	}
+	if info.StartToken != "" {
+		device.ActivityStartToken = info.StartToken
+	}
+	if _, err := db.SaveDevice(info.DeviceKey, device); err != nil {
+		logger.Errorf("live activity registration failed: %v", err)
+		return c.Status(500).JSON(failed(500, "live activity registration failed: %v", err))
+	}
+	return c.JSON(success())
+}
+
+func routeDoPushLiveActivity(c *fiber.Ctx) error {
+	var req LiveActivityRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	result, err := pushLiveActivity(c.Params("event"), &req)
+	return pushResponse(c, result, err)
+}
+
+func pushLiveActivity(event string, req *LiveActivityRequest) (pushResult, error) {
+	if req.DeviceKey == "" {
+		return pushResult{Code: 400}, fmt.Errorf("device key is empty")
+	}
+	msg := apns.LiveActivityMessage{
+		Event:          event,
+		ContentState:   req.ContentState,
+		AttributesType: req.AttributesType,
+		Attributes:     req.Attributes,
+		Title:          req.Title,
+		Body:           req.Body,
+		Sound:          req.Sound,
+		Priority:       req.Priority,
+	}
+	now := time.Now()
+	for _, date := range []struct {
+		name  string
+		value interface{}
+		t     *time.Time
+	}{
+		{"stale_date", req.StaleDate, &msg.StaleDate},
+		{"dismissal_date", req.DismissalDate, &msg.DismissalDate},
+	} {
+		if date.value == nil {
+			continue
+		}
+		t, err := apns.ParseTime(paramString(date.value), now)
+		if err != nil {
+			return pushResult{Code: 400}, fmt.Errorf("invalid %s: %v", date.name, err)
+		}
+		*date.t = t
+	}
+	if err := msg.Validate(); err != nil {
+		return pushResult{Code: 400}, err
+	}
+
+	device, err := db.DeviceByKey(req.DeviceKey)
+	if err != nil {
+		return pushResult{Code: 400}, fmt.Errorf("failed to get device: %v", err)
+	}
+	if device.Platform != "" && device.Platform != PlatformIOS {
+		return pushResult{Code: 400}, fmt.Errorf("live activities are only supported on ios devices")
+	}
+	token := activityToken(device, event)
+	if *token == "" {
+		return pushResult{Code: 400}, fmt.Errorf("no live activity token registered for %s", event)
+	}
+	msg.DeviceToken = *token
+	msg.Environment = device.Environment
+	msg.Profile = device.Profile
+
+	apnsRes, err := apns.PushLiveActivity(&msg)
+	res := apnsResult(apnsRes)
+	result := pushResult{Code: 200, Retries: res.Retries, ApnsID: res.ApnsID, ApnsUniqueID: res.ApnsUniqueID}
+	logDelivery("", req.DeviceKey, res)
+
+	// The activity ended or the token expired, delete it from database,
+	// unless a new token was registered during the push
+	if res.Unregistered {
+		_ = db.UpdateDevice(req.DeviceKey, func(device *database.Device) bool {
+			token := activityToken(device, event)
+			if *token != msg.DeviceToken {
+				return false
+			}
+			*token = ""
+			return true
+		})
+	}
+	if err != nil {
+		result.Code = 500
+		if res.StatusCode == fiber.StatusRequestEntityTooLarge {
+			result.Code = res.StatusCode
+		}
+		return result, fmt.Errorf("push failed: %v", err)
+	}
+	return result, nil
+}
+
+// activityToken returns the token of the device the event is pushed to,
+// new activities are started with the push-to-start token
+func activityToken(device *database.Device, event string) *string {
+	if event == apns.LiveActivityStart {
+		return &device.ActivityStartToken
+	}
+	return &device.ActivityToken
+}
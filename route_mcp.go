@@ -93,9 +93,9 @@ func notifyHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallT
 	}
 
 	args["device_key"] = deviceKey
-	code, err := push(args)
+	res, err := push(args)
 	if err != nil {
-		return mcp.NewToolResultError(fmt.Sprintf("Failed to send notification: %v (code %d)", err, code)), nil
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to send notification: %v (code %d)", err, res.Code)), nil
 	}
 	return mcp.NewToolResultText("Notification sent successfully"), nil
 }
@@ -126,5 +126,15 @@ func getCommonToolOpts() []mcp.ToolOption {
 		mcp.WithString("isArchive", mcp.Description("Set to '1' to save the notification or any other value to skip saving")),
 		mcp.WithString("url", mcp.Description("Click action URL")),
 		mcp.WithString("copy", mcp.Description("Text to copy on copy action")),
+		mcp.WithString("priority",
+			mcp.Description("APNs priority, 10 delivers immediately, 5 lets the device save power"),
+			mcp.Enum("1", "5", "10"),
+		),
+		mcp.WithString("expiration", mcp.Description("Seconds to keep retrying delivery, a unix timestamp or an RFC3339 date, 0 delivers now or never")),
+		mcp.WithString("collapse_id", mcp.Description("Notifications with the same collapse id replace each other, up to 64 bytes")),
+		mcp.WithString("push_type",
+			mcp.Description("APNs push type"),
+			mcp.Enum("alert", "background"),
+		),
 	}
 }
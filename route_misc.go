@@ -4,6 +4,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/finb/bark-server/v2/apns"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -40,5 +41,10 @@ func init() {
 				"devices": devices,
 			})
 		})
+
+		// apns func returns the statistics of the APNs client connections
+		router.Get("/info/apns", func(c *fiber.Ctx) error {
+			return c.JSON(data(apns.Stats()))
+		})
 	})
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GrafanaWebhook is the payload of the Grafana alerting webhook contact point, an
+// Alertmanager notification with the title and message rendered by Grafana
+type GrafanaWebhook struct {
+	AlertmanagerWebhook
+	Alerts  []GrafanaAlert `json:"alerts"`
+	OrgID   int64          `json:"orgId"`
+	Title   string         `json:"title"`
+	State   string         `json:"state"`
+	Message string         `json:"message"`
+}
+
+type GrafanaAlert struct {
+	AlertmanagerAlert
+	SilenceURL   string `json:"silenceURL"`
+	DashboardURL string `json:"dashboardURL"`
+	PanelURL     string `json:"panelURL"`
+	ValueString  string `json:"valueString"`
+}
+
+// UptimeKumaWebhook is the payload of the Uptime Kuma webhook notification,
+// the test notifications have no heartbeat and monitor
+type UptimeKumaWebhook struct {
+	Heartbeat *struct {
+		Status int    `json:"status"`
+		Msg    string `json:"msg"`
+		Time   string `json:"time"`
+	} `json:"heartbeat"`
+	Monitor *struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+		Type string `json:"type"`
+	} `json:"monitor"`
+	Msg string `json:"msg"`
+}
+
+// Heartbeat status of Uptime Kuma monitors
+var uptimeKumaStatus = map[int]string{
+	0: "Down",
+	1: "Up",
+	2: "Pending",
+	3: "Maintenance",
+}
+
+// NetdataWebhook is the payload of the Netdata Cloud webhook integration
+type NetdataWebhook struct {
+	Message  string `json:"message"`
+	Alarm    string `json:"alarm"`
+	Info     string `json:"info"`
+	Chart    string `json:"chart"`
+	Context  string `json:"context"`
+	Space    string `json:"space"`
+	Room     string `json:"room"`
+	Family   string `json:"family"`
+	Class    string `json:"class"`
+	Severity string `json:"severity"`
+	Date     string `json:"date"`
+	Duration string `json:"duration"`
+	// Other alerts of the space still active
+	ActiveCritical int    `json:"additional_active_critical_alerts"`
+	ActiveWarning  int    `json:"additional_active_warning_alerts"`
+	AlarmURL       string `json:"alarm_url"`
+}
+
+// Interruption levels of the Netdata alert severities
+var netdataLevels = map[string]string{
+	"critical": "critical",
+	"warning":  "timeSensitive",
+	"clear":    "active",
+}
+
+func init() {
+	registerRoute("monitoring", func(router fiber.Router) {
+		router.Post("/webhook/grafana/:device_key", receiverHandler(parseGrafana))
+		router.Post("/webhook/uptime-kuma/:device_key", receiverHandler(parseUptimeKuma))
+		router.Post("/webhook/netdata/:device_key", receiverHandler(parseNetdata))
+	})
+}
+
+// receiverHandler pushes the parameters mapped from the request body by the parser
+func receiverHandler(parse func(body []byte) (map[string]interface{}, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		params, err := parse(c.Body())
+		if err != nil {
+			return c.Status(400).JSON(failed(400, "%s", err.Error()))
+		}
+		result, err := receiverPush(c, params)
+		return pushResponse(c, result, err)
+	}
+}
+
+func parseGrafana(body []byte) (map[string]interface{}, error) {
+	var payload GrafanaWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid grafana payload: %v", err)
+	}
+	if len(payload.Alerts) == 0 {
+		return nil, fmt.Errorf("invalid grafana payload: no alerts")
+	}
+	alerts := make([]AlertmanagerAlert, 0, len(payload.Alerts))
+	for _, alert := range payload.Alerts {
+		alerts = append(alerts, alert.AlertmanagerAlert)
+	}
+
+	name := payload.CommonLabels["alertname"]
+	if name == "" {
+		name = "Grafana"
+	}
+	params := map[string]interface{}{
+		"title": payload.Title,
+		"body":  alertGroupBody(payload.Status, alerts, payload.TruncatedAlerts),
+		"group": name,
+	}
+	if payload.Title == "" {
+		params["title"] = alertGroupTitle(payload.Status, alerts, payload.TruncatedAlerts, name)
+	}
+	if params["body"] == "" {
+		params["body"] = strings.TrimSpace(payload.Message)
+	}
+	if payload.Status == "firing" && hasCriticalAlert(alerts) {
+		params["level"] = "critical"
+	}
+	// The panel of the first alert, or the alert rule
+	for _, alert := range payload.Alerts {
+		for _, url := range []string{alert.PanelURL, alert.DashboardURL, alert.GeneratorURL} {
+			if url != "" && params["url"] == nil {
+				params["url"] = url
+			}
+		}
+	}
+	if params["url"] == nil && payload.ExternalURL != "" {
+		params["url"] = payload.ExternalURL
+	}
+	return params, nil
+}
+
+func parseUptimeKuma(body []byte) (map[string]interface{}, error) {
+	var payload UptimeKumaWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid uptime kuma payload: %v", err)
+	}
+	if payload.Msg == "" && payload.Heartbeat == nil {
+		return nil, fmt.Errorf("invalid uptime kuma payload: no message")
+	}
+
+	params := map[string]interface{}{
+		"title": "Uptime Kuma",
+		"body":  payload.Msg,
+		"group": "Uptime Kuma",
+	}
+	if payload.Monitor != nil && payload.Heartbeat != nil {
+		status, ok := uptimeKumaStatus[payload.Heartbeat.Status]
+		if !ok {
+			status = fmt.Sprintf("Status %d", payload.Heartbeat.Status)
+		}
+		params["title"] = fmt.Sprintf("[%s] %s", status, payload.Monitor.Name)
+		if payload.Heartbeat.Msg != "" {
+			params["body"] = payload.Heartbeat.Msg
+		}
+		if payload.Heartbeat.Status == 0 {
+			params["level"] = "timeSensitive"
+		}
+		// Only the http monitors have a URL worth opening
+		if strings.HasPrefix(payload.Monitor.URL, "http://") || strings.HasPrefix(payload.Monitor.URL, "https://") {
+			params["url"] = payload.Monitor.URL
+		}
+	}
+	return params, nil
+}
+
+func parseNetdata(body []byte) (map[string]interface{}, error) {
+	var payload NetdataWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid netdata payload: %v", err)
+	}
+	if payload.Message == "" && payload.Alarm == "" {
+		return nil, fmt.Errorf("invalid netdata payload: no alert")
+	}
+
+	title := payload.Message
+	if title == "" {
+		title = fmt.Sprintf("[%s] %s", strings.ToUpper(payload.Severity), payload.Alarm)
+	}
+	lines := []string{payload.Info}
+	if payload.ActiveCritical > 0 || payload.ActiveWarning > 0 {
+		lines = append(lines, fmt.Sprintf("Also active: %d critical, %d warning", payload.ActiveCritical, payload.ActiveWarning))
+	}
+	params := map[string]interface{}{
+		"title": title,
+		"body":  strings.TrimSpace(strings.Join(lines, "\n")),
+		"group": "Netdata",
+	}
+	if payload.Space != "" {
+		params["subtitle"] = strings.TrimSuffix(payload.Space+" / "+payload.Room, " / ")
+	}
+	if level, ok := netdataLevels[payload.Severity]; ok {
+		params["level"] = level
+	}
+	if payload.AlarmURL != "" {
+		params["url"] = payload.AlarmURL
+	}
+	return params, nil
+}
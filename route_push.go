@@ -3,12 +3,16 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2/utils"
 
 	"github.com/finb/bark-server/v2/apns"
+	"github.com/finb/bark-server/v2/database"
+	"github.com/sideshow/apns2"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -16,10 +20,29 @@ import (
 // Maximum number of batch pushes allowed, -1 means no limit
 var maxBatchPushCount = -1
 
+// silentPushLocal marks the requests of /push/silent
+const silentPushLocal = "silent_push"
+
+// pushResult is the outcome of a push, reported in the response data
+type pushResult struct {
+	Code int `json:"-"`
+	// Number of APNs retries after transient failures
+	Retries int `json:"retries"`
+	// apns-id of the notification, apns-unique-id in the development environment only
+	ApnsID       string `json:"apns_id,omitempty"`
+	ApnsUniqueID string `json:"apns_unique_id,omitempty"`
+	// Email sent instead of the undeliverable push
+	Fallback *fallbackResult `json:"fallback,omitempty"`
+}
+
 func init() {
 	// V2 API
 	registerRoute("push", func(router fiber.Router) {
 		router.Post("/push", func(c *fiber.Ctx) error { return routeDoPush(c) })
+		router.Post("/push/silent", func(c *fiber.Ctx) error {
+			c.Locals(silentPushLocal, true)
+			return routeDoPush(c)
+		})
 	})
 
 	// compatible with old requests
@@ -82,12 +105,8 @@ func routeDoPushV1(c *fiber.Ctx) error {
 		params[key] = val
 	}
 
-	code, err := push(params)
-	if err != nil {
-		return c.Status(code).JSON(failed(code, "%s", err.Error()))
-	} else {
-		return c.JSON(success())
-	}
+	result, err := push(params)
+	return pushResponse(c, result, err)
 }
 func routeDoPushV2(c *fiber.Ctx) error {
 	params := make(map[string]interface{})
@@ -128,12 +147,8 @@ func routeDoPushV2(c *fiber.Ctx) error {
 
 	if count == 0 {
 		// Single push
-		code, err := push(params)
-		if err != nil {
-			return c.Status(code).JSON(failed(code, "%s", err.Error()))
-		} else {
-			return c.JSON(success())
-		}
+		result, err := push(params)
+		return pushResponse(c, result, err)
 	} else {
 		// Batch push
 		if count > maxBatchPushCount && maxBatchPushCount != -1 {
@@ -157,7 +172,7 @@ func routeDoPushV2(c *fiber.Ctx) error {
 				defer wg.Done()
 
 				// Push
-				code, err := push(newParams)
+				res, err := push(newParams)
 
 				// Save result
 				mu.Lock()
@@ -165,7 +180,17 @@ func routeDoPushV2(c *fiber.Ctx) error {
 				if err != nil {
 					result[i]["message"] = err.Error()
 				}
-				result[i]["code"] = code
+				result[i]["code"] = res.Code
+				result[i]["retries"] = res.Retries
+				if res.ApnsID != "" {
+					result[i]["apns_id"] = res.ApnsID
+				}
+				if res.ApnsUniqueID != "" {
+					result[i]["apns_unique_id"] = res.ApnsUniqueID
+				}
+				if res.Fallback != nil {
+					result[i]["fallback"] = res.Fallback
+				}
 				result[i]["device_key"] = deviceKeys[i]
 				mu.Unlock()
 			}(i, newParams)
@@ -175,9 +200,22 @@ func routeDoPushV2(c *fiber.Ctx) error {
 	}
 }
 
+// pushResponse writes the push result, the result is included in the data of failed pushes too
+func pushResponse(c *fiber.Ctx, result pushResult, err error) error {
+	if err != nil {
+		resp := failed(result.Code, "%s", err.Error())
+		resp.Data = result
+		return c.Status(result.Code).JSON(resp)
+	}
+	return c.JSON(data(result))
+}
+
 func extractUrlPathParams(c *fiber.Ctx) (map[string]interface{}, error) {
 	// parse url path (highest priority)
 	params := make(map[string]interface{})
+	if c.Locals(silentPushLocal) != nil {
+		params["silent"] = "1"
+	}
 	if pathDeviceKey := c.Params("device_key"); pathDeviceKey != "" {
 		params["device_key"] = pathDeviceKey
 	}
@@ -205,15 +243,58 @@ func extractUrlPathParams(c *fiber.Ctx) (map[string]interface{}, error) {
 	return params, nil
 }
 
-func push(params map[string]interface{}) (int, error) {
+func push(params map[string]interface{}) (pushResult, error) {
 	// default value
 	msg := apns.PushMessage{
 		Body:      "",
 		Sound:     "1107",
 		ExtParams: make(map[string]interface{}),
 	}
+	// Background push carrying the custom data only
+	silent := false
 
 	for key, val := range params {
+		switch strings.ToLower(key) {
+		case "priority", "expiration", "collapse_id", "push_type":
+			// APNs request headers, not part of the payload
+			if err := msg.SetHeader(strings.ToLower(key), paramString(val)); err != nil {
+				return pushResult{Code: 400}, err
+			}
+			continue
+		case "relevance_score", "target_content_id", "filter_criteria":
+			if err := msg.SetApsField(strings.ToLower(key), val); err != nil {
+				return pushResult{Code: 400}, err
+			}
+			continue
+		case "title_loc_key", "title_loc_args", "subtitle_loc_key", "subtitle_loc_args", "loc_key", "loc_args":
+			if err := msg.SetLocField(strings.ToLower(key), val); err != nil {
+				return pushResult{Code: 400}, err
+			}
+			continue
+		case "level":
+			if err := msg.SetApsField("level", val); err != nil {
+				return pushResult{Code: 400}, err
+			}
+			// Also passed to the app as a custom field, the value is kept as sent
+		case "silent":
+			switch paramString(val) {
+			case "1", "true":
+				silent = true
+			}
+			continue
+		case "badge":
+			if paramString(val) == "" {
+				continue
+			}
+			badge, err := apns.ParseBadge(val)
+			if err != nil {
+				return pushResult{Code: 400}, err
+			}
+			msg.Badge = &badge
+			// Also passed to the app as a custom field
+			msg.ExtParams["badge"] = badge
+			continue
+		}
 		switch val := val.(type) {
 		case string:
 			switch strings.ToLower(string(key)) {
@@ -229,16 +310,22 @@ func push(params map[string]interface{}) (int, error) {
 			case "body":
 				msg.Body = val
 			case "sound":
-				// Compatible with old parameters
-				if strings.HasSuffix(val, ".caf") {
-					msg.Sound = val
-				} else {
-					msg.Sound = val + ".caf"
-				}
+				msg.Sound = apns.SoundFile(val)
 			default:
 				msg.ExtParams[strings.ToLower(string(key))] = val
 			}
 		case map[string]interface{}:
+			if strings.ToLower(key) == "sound" {
+				sound, err := apns.ParseSound(val)
+				if err != nil {
+					return pushResult{Code: 400}, err
+				}
+				if name, ok := sound["name"].(string); ok {
+					sound["name"] = apns.SoundFile(name)
+				}
+				msg.SoundDict = sound
+				continue
+			}
 			for k, v := range val {
 				msg.ExtParams[k] = v
 			}
@@ -248,7 +335,16 @@ func push(params map[string]interface{}) (int, error) {
 	}
 
 	if msg.DeviceKey == "" {
-		return 400, fmt.Errorf("device key is empty")
+		return pushResult{Code: 400}, fmt.Errorf("device key is empty")
+	}
+	if silent {
+		if msg.PushType != "" && msg.PushType != apns2.PushTypeBackground {
+			return pushResult{Code: 400}, fmt.Errorf("silent pushes can't use push_type %s", msg.PushType)
+		}
+		msg.PushType = apns2.PushTypeBackground
+	}
+	if err := msg.Validate(); err != nil {
+		return pushResult{Code: 400}, err
 	}
 
 	if msg.IsEmptyAlert() {
@@ -256,21 +352,82 @@ func push(params map[string]interface{}) (int, error) {
 		msg.Body = "Empty Message"
 	}
 
-	deviceToken, err := db.DeviceTokenByKey(msg.DeviceKey)
+	device, err := db.DeviceByKey(msg.DeviceKey)
+	if err != nil {
+		return pushResult{Code: 400}, fmt.Errorf("failed to get device token: %v", err)
+	}
+
+	msg.DeviceToken = device.Token
+	msg.Environment = device.Environment
+	msg.Profile = device.Profile
+	message := newMessage(&msg)
+
+	if device.IsInvalidated() {
+		return emailFallback(message, device, pushResult{Code: 400}, fmt.Errorf("device token was invalidated by its push service at %s (%s), register the device again",
+			time.Unix(device.InvalidatedAt, 0).UTC().Format(time.RFC3339), device.InvalidReason))
+	}
+
+	notifier, err := notifierFor(device.Platform)
 	if err != nil {
-		return 400, fmt.Errorf("failed to get device token: %v", err)
+		return emailFallback(message, device, pushResult{Code: 400}, err)
 	}
 
-	msg.DeviceToken = deviceToken
+	releaseSilent := func() {}
+	if silent {
+		release, wait := reserveSilentPush(msg.DeviceKey, time.Now())
+		if release == nil {
+			return pushResult{Code: 429}, fmt.Errorf("too many silent pushes, retry after %ds", int(wait.Seconds())+1)
+		}
+		releaseSilent = release
+	}
 
-	code, err := apns.Push(&msg)
+	res, err := notifier.Push(device, message)
+	result := pushResult{Code: 200, Retries: res.Retries, ApnsID: res.ApnsID, ApnsUniqueID: res.ApnsUniqueID}
+	logDelivery(msg.Id, msg.DeviceKey, res)
 
-	// Invalid token, delete it from database.
-	if code == 410 || (code == 400 && strings.Contains(err.Error(), "BadDeviceToken")) {
-		_, _ = db.SaveDeviceTokenByKey(msg.DeviceKey, "")
+	// Invalid token, keep it with the time and reason the push service reported
+	if res.Unregistered {
+		invalidatedAt := res.UnregisteredAt
+		if invalidatedAt.IsZero() {
+			invalidatedAt = time.Now()
+		}
+		// The device may have been registered again during the push, only the token pushed to is marked
+		if device.Invalidate(invalidatedAt, res.Reason) {
+			_ = db.UpdateDevice(msg.DeviceKey, func(stored *database.Device) bool {
+				return stored.Token == device.Token && stored.Invalidate(invalidatedAt, res.Reason)
+			})
+		}
 	}
 	if err != nil {
-		return 500, fmt.Errorf("push failed: %v", err)
+		releaseSilent()
+		result.Code = 500
+		if res.StatusCode == fiber.StatusRequestEntityTooLarge {
+			result.Code = res.StatusCode
+		}
+		return emailFallback(message, device, result, fmt.Errorf("push failed: %v", err))
+	}
+	// The first accepted push marks the token as delivered to, once, unless the device was registered again
+	if device.DeliveredAt == 0 {
+		deliveredAt := time.Now().Unix()
+		_ = db.UpdateDevice(msg.DeviceKey, func(stored *database.Device) bool {
+			if stored.Token != device.Token || stored.RegisteredAt != device.RegisteredAt || stored.DeliveredAt != 0 {
+				return false
+			}
+			stored.DeliveredAt = deliveredAt
+			return true
+		})
+	}
+	return result, nil
+}
+
+// paramString formats a scalar parameter, JSON numbers are decoded as float64
+func paramString(val interface{}) string {
+	switch val := val.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", val)
 	}
-	return 200, nil
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"time"
+
+	"github.com/finb/bark-server/v2/apns"
+	"github.com/finb/bark-server/v2/database"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mritd/logger"
 )
@@ -8,6 +12,12 @@ import (
 type DeviceInfo struct {
 	DeviceKey   string `form:"device_key,omitempty" json:"device_key,omitempty" xml:"device_key,omitempty" query:"device_key,omitempty"`
 	DeviceToken string `form:"device_token,omitempty" json:"device_token,omitempty" xml:"device_token,omitempty" query:"device_token,omitempty"`
+	// APNs environment of the app build: production (default), development or sandbox
+	Environment string `form:"environment,omitempty" json:"environment,omitempty" xml:"environment,omitempty" query:"environment,omitempty"`
+	// APNs credential profile of the app build, empty means the default profile
+	Profile string `form:"profile,omitempty" json:"profile,omitempty" xml:"profile,omitempty" query:"profile,omitempty"`
+	// Platform of the device: ios (default) or android, Android devices register their FCM registration token
+	Platform string `form:"platform,omitempty" json:"platform,omitempty" xml:"platform,omitempty" query:"platform,omitempty"`
 
 	// compatible with old req
 	OldDeviceKey   string `form:"key,omitempty" json:"key,omitempty" xml:"key,omitempty" query:"key,omitempty"`
@@ -55,9 +65,36 @@ func doRegister(c *fiber.Ctx, compat bool) error {
 		return c.Status(400).JSON(failed(400, "device token is invalid"))
 	}
 
+	environment, err := apns.ParseEnvironment(deviceInfo.Environment)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+	deviceInfo.Environment = environment
+
+	platform, err := parsePlatform(deviceInfo.Platform)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+	deviceInfo.Platform = platform
+
+	profile, err := apns.ParseProfile(deviceInfo.Profile)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+	deviceInfo.Profile = profile
+
 	// if deviceInfo.DeviceKey=="", newKey will be filled with a new uuid
 	// otherwise it equal to deviceInfo.DeviceKey
-	newKey, err := db.SaveDeviceTokenByKey(deviceInfo.DeviceKey, deviceInfo.DeviceToken)
+	// Registering again validates a token invalidated before now
+	device := &database.Device{
+		Token:        deviceInfo.DeviceToken,
+		Platform:     deviceInfo.Platform,
+		Environment:  deviceInfo.Environment,
+		Profile:      deviceInfo.Profile,
+		RegisteredAt: time.Now().Unix(),
+	}
+	keepDeviceSettings(deviceInfo.DeviceKey, device)
+	newKey, err := db.SaveDevice(deviceInfo.DeviceKey, device)
 	if err != nil {
 		logger.Errorf("device registration failed: %v", err)
 		return c.Status(500).JSON(failed(500, "device registration failed: %v", err))
@@ -69,6 +106,9 @@ func doRegister(c *fiber.Ctx, compat bool) error {
 		"key":          deviceInfo.DeviceKey,
 		"device_key":   deviceInfo.DeviceKey,
 		"device_token": deviceInfo.DeviceToken,
+		"environment":  deviceInfo.Environment,
+		"profile":      deviceInfo.Profile,
+		"platform":     deviceInfo.Platform,
 	}))
 }
 
@@ -79,9 +119,36 @@ func doRegisterCheck(c *fiber.Ctx) error {
 		return c.Status(400).JSON(failed(400, "device key is empty"))
 	}
 
-	_, err := db.DeviceTokenByKey(deviceKey)
+	device, err := db.DeviceByKey(deviceKey)
 	if err != nil {
 		return c.Status(400).JSON(failed(400, "%s", err.Error()))
 	}
+	if device.IsInvalidated() {
+		resp := failed(400, "device token was invalidated by its push service: %s", device.InvalidReason)
+		resp.Data = map[string]interface{}{
+			"invalidated_at": device.InvalidatedAt,
+			"invalid_reason": device.InvalidReason,
+		}
+		return c.Status(400).JSON(resp)
+	}
 	return c.Status(200).JSON(success())
 }
+
+// keepDeviceSettings keeps the settings registered to the key separately from its token,
+// the Live Activity tokens, the fallback email and the receiver secret, when the key registers again,
+// and whether the token was delivered to when it registers the same token
+func keepDeviceSettings(deviceKey string, device *database.Device) {
+	if deviceKey == "" {
+		return
+	}
+	// The stored record is read as is, the settings are kept even if its token is invalid
+	if old, err := db.StoredDevice(deviceKey); err == nil {
+		device.ActivityToken = old.ActivityToken
+		device.ActivityStartToken = old.ActivityStartToken
+		device.FallbackEmail = old.FallbackEmail
+		device.ReceiverSecret = old.ReceiverSecret
+		if old.Token == device.Token {
+			device.DeliveredAt = old.DeliveredAt
+		}
+	}
+}
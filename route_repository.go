@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+type ReceiverSecretInfo struct {
+	DeviceKey string `form:"device_key,omitempty" json:"device_key,omitempty" xml:"device_key,omitempty" query:"device_key,omitempty"`
+	// Empty generates a new secret
+	Secret string `form:"secret,omitempty" json:"secret,omitempty" xml:"secret,omitempty" query:"secret,omitempty"`
+	// The secret being replaced, required when the key has one
+	CurrentSecret string `form:"current_secret,omitempty" json:"current_secret,omitempty" xml:"current_secret,omitempty" query:"current_secret,omitempty"`
+}
+
+// GitHubWebhook holds the fields of the GitHub webhook events pushed by the receiver
+type GitHubWebhook struct {
+	Action      string `json:"action"`
+	WorkflowRun *struct {
+		Name         string `json:"name"`
+		DisplayTitle string `json:"display_title"`
+		HeadBranch   string `json:"head_branch"`
+		RunNumber    int    `json:"run_number"`
+		Conclusion   string `json:"conclusion"`
+		HTMLURL      string `json:"html_url"`
+	} `json:"workflow_run"`
+	Release *struct {
+		TagName    string `json:"tag_name"`
+		Name       string `json:"name"`
+		Body       string `json:"body"`
+		Prerelease bool   `json:"prerelease"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"release"`
+	Review *struct {
+		State   string `json:"state"`
+		Body    string `json:"body"`
+		HTMLURL string `json:"html_url"`
+		User    struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"review"`
+	PullRequest *struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// GitLabWebhook holds the fields of the GitLab webhook events pushed by the receiver
+type GitLabWebhook struct {
+	ObjectKind string `json:"object_kind"`
+	// Action of the release events
+	Action           string `json:"action"`
+	ObjectAttributes struct {
+		ID     int64  `json:"id"`
+		IID    int64  `json:"iid"`
+		Ref    string `json:"ref"`
+		Status string `json:"status"`
+		Title  string `json:"title"`
+		Action string `json:"action"`
+		URL    string `json:"url"`
+	} `json:"object_attributes"`
+	User struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Commit *struct {
+		Title string `json:"title"`
+	} `json:"commit"`
+	// Release events
+	Tag         string `json:"tag"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	Project     struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+}
+
+// Events pushed by the receivers unless ?events= selects others
+var (
+	githubEvents = []string{"workflow_run", "release", "pull_request_review"}
+	gitlabEvents = []string{"pipeline", "release", "merge_request"}
+)
+
+// Conclusions of the failed GitHub workflow runs
+var githubWorkflowFailures = map[string]string{
+	"failure":         "failed",
+	"timed_out":       "timed out",
+	"startup_failure": "failed to start",
+}
+
+var githubReviewStates = map[string]string{
+	"approved":          "approved",
+	"changes_requested": "changes requested",
+	"commented":         "reviewed",
+}
+
+// Merge request actions of the GitLab approvals
+var gitlabApprovalActions = map[string]string{
+	"approved":   "approved",
+	"approval":   "approved",
+	"unapproved": "unapproved",
+	"unapproval": "unapproved",
+}
+
+func init() {
+	registerRoute("repository", func(router fiber.Router) {
+		router.Post("/receiver-secret/register", routeDoRegisterReceiverSecret)
+		router.Post("/webhook/github/:device_key", routeDoGitHub)
+		router.Post("/webhook/gitlab/:device_key", routeDoGitLab)
+	})
+}
+
+// routeDoRegisterReceiverSecret sets the secret verifying the GitHub and GitLab
+// webhooks of an existing device key, it's kept when the device registers again.
+// Replacing a secret takes the current one, unless the basic auth users replace it
+func routeDoRegisterReceiverSecret(c *fiber.Ctx) error {
+	var info ReceiverSecretInfo
+	if err := c.BodyParser(&info); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if info.DeviceKey == "" {
+		return c.Status(400).JSON(failed(400, "device key is empty"))
+	}
+	if info.Secret == "" {
+		secret, err := randomSecret()
+		if err != nil {
+			return c.Status(500).JSON(failed(500, "failed to generate receiver secret: %v", err))
+		}
+		info.Secret = secret
+	}
+
+	device, err := db.DeviceByKey(info.DeviceKey)
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "failed to get device: %v", err))
+	}
+	if device.ReceiverSecret != "" && !basicAuthEnabled &&
+		subtle.ConstantTimeCompare([]byte(info.CurrentSecret), []byte(device.ReceiverSecret)) != 1 {
+		return c.Status(403).JSON(failed(403, "the current receiver secret is required to replace it"))
+	}
+	device.ReceiverSecret = info.Secret
+	if _, err := db.SaveDevice(info.DeviceKey, device); err != nil {
+		logger.Errorf("receiver secret registration failed: %v", err)
+		return c.Status(500).JSON(failed(500, "receiver secret registration failed: %v", err))
+	}
+	return c.JSON(data(map[string]string{"secret": info.Secret}))
+}
+
+// randomSecret generates a random 256 bits secret, hex encoded
+func randomSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// verifyReceiver checks the request of a repository webhook with the receiver secret of
+// the device, it writes the error response and returns false when the check fails
+func verifyReceiver(c *fiber.Ctx, verify func(secret string) bool) bool {
+	device, err := db.DeviceByKey(c.Params("device_key"))
+	if err != nil {
+		_ = c.Status(400).JSON(failed(400, "failed to get device: %v", err))
+		return false
+	}
+	if device.ReceiverSecret == "" {
+		_ = c.Status(403).JSON(failed(403, "the device has no receiver secret"))
+		return false
+	}
+	if !verify(device.ReceiverSecret) {
+		_ = c.Status(401).JSON(failed(401, "invalid webhook signature"))
+		return false
+	}
+	return true
+}
+
+// githubSignatureValid checks the X-Hub-Signature-256 header, the HMAC-SHA256 of the body
+func githubSignatureValid(secret, signature string, body []byte) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func routeDoGitHub(c *fiber.Ctx) error {
+	if !verifyReceiver(c, func(secret string) bool {
+		return githubSignatureValid(secret, c.Get("X-Hub-Signature-256"), c.Body())
+	}) {
+		return nil
+	}
+
+	event := c.Get("X-GitHub-Event")
+	if event == "ping" {
+		return c.JSON(success())
+	}
+	if !receiverEvents(c, githubEvents...)[event] {
+		return receiverIgnored(c, event)
+	}
+	params, err := parseGitHub(event, c.Body())
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+	if params == nil {
+		return receiverIgnored(c, event)
+	}
+	result, err := receiverPush(c, params)
+	return pushResponse(c, result, err)
+}
+
+// parseGitHub maps a GitHub event to the push parameters, it returns nil parameters
+// for the actions which are not pushed
+func parseGitHub(event string, body []byte) (map[string]interface{}, error) {
+	var payload GitHubWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid github payload: %v", err)
+	}
+	repo := payload.Repository.FullName
+	params := map[string]interface{}{"group": repo}
+
+	switch {
+	case event == "workflow_run" && payload.WorkflowRun != nil:
+		run := payload.WorkflowRun
+		failure, ok := githubWorkflowFailures[run.Conclusion]
+		if payload.Action != "completed" || !ok {
+			return nil, nil
+		}
+		params["title"] = fmt.Sprintf("[%s] %s #%d %s", repo, run.Name, run.RunNumber, failure)
+		params["body"] = fmt.Sprintf("%s\non %s", shortText(run.DisplayTitle, maxReceiverBodyLength), run.HeadBranch)
+		params["url"] = run.HTMLURL
+		params["level"] = "timeSensitive"
+	case event == "release" && payload.Release != nil:
+		release := payload.Release
+		if payload.Action != "published" {
+			return nil, nil
+		}
+		kind := "Release"
+		if release.Prerelease {
+			kind = "Pre-release"
+		}
+		params["title"] = fmt.Sprintf("[%s] %s %s", repo, kind, release.TagName)
+		params["body"] = shortText(release.Body, maxReceiverBodyLength)
+		if release.Name != "" && release.Name != release.TagName {
+			params["body"] = strings.TrimSpace(release.Name + "\n" + params["body"].(string))
+		}
+		params["url"] = release.HTMLURL
+	case event == "pull_request_review" && payload.Review != nil && payload.PullRequest != nil:
+		review, pr := payload.Review, payload.PullRequest
+		state, ok := githubReviewStates[review.State]
+		if payload.Action != "submitted" || !ok {
+			return nil, nil
+		}
+		params["title"] = fmt.Sprintf("[%s] PR #%d %s by %s", repo, pr.Number, state, review.User.Login)
+		params["body"] = strings.TrimSpace(pr.Title + "\n" + shortText(review.Body, maxReceiverBodyLength))
+		params["url"] = review.HTMLURL
+	default:
+		return nil, nil
+	}
+	if params["body"] == "" {
+		params["body"] = repo
+	}
+	return params, nil
+}
+
+func routeDoGitLab(c *fiber.Ctx) error {
+	if !verifyReceiver(c, func(secret string) bool {
+		return subtle.ConstantTimeCompare([]byte(c.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	}) {
+		return nil
+	}
+
+	var kind struct {
+		ObjectKind string `json:"object_kind"`
+	}
+	if err := json.Unmarshal(c.Body(), &kind); err != nil {
+		return c.Status(400).JSON(failed(400, "invalid gitlab payload: %v", err))
+	}
+	if !receiverEvents(c, gitlabEvents...)[kind.ObjectKind] {
+		return receiverIgnored(c, kind.ObjectKind)
+	}
+	params, err := parseGitLab(c.Body())
+	if err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+	if params == nil {
+		return receiverIgnored(c, kind.ObjectKind)
+	}
+	result, err := receiverPush(c, params)
+	return pushResponse(c, result, err)
+}
+
+// parseGitLab maps a GitLab event to the push parameters, it returns nil parameters
+// for the actions which are not pushed
+func parseGitLab(body []byte) (map[string]interface{}, error) {
+	var payload GitLabWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid gitlab payload: %v", err)
+	}
+	project := payload.Project.PathWithNamespace
+	attrs := payload.ObjectAttributes
+	params := map[string]interface{}{"group": project}
+
+	switch payload.ObjectKind {
+	case "pipeline":
+		if attrs.Status != "failed" {
+			return nil, nil
+		}
+		params["title"] = fmt.Sprintf("[%s] Pipeline #%d failed", project, attrs.ID)
+		params["body"] = "on " + attrs.Ref
+		if payload.Commit != nil && payload.Commit.Title != "" {
+			params["body"] = shortText(payload.Commit.Title, maxReceiverBodyLength) + "\non " + attrs.Ref
+		}
+		// The pipeline URL is sent by GitLab 15.6 or later
+		params["url"] = attrs.URL
+		if attrs.URL == "" {
+			params["url"] = fmt.Sprintf("%s/-/pipelines/%d", payload.Project.WebURL, attrs.ID)
+		}
+		params["level"] = "timeSensitive"
+	case "release":
+		if payload.Action != "create" {
+			return nil, nil
+		}
+		params["title"] = fmt.Sprintf("[%s] Release %s", project, payload.Tag)
+		params["body"] = shortText(payload.Description, maxReceiverBodyLength)
+		if payload.Name != "" && payload.Name != payload.Tag {
+			params["body"] = strings.TrimSpace(payload.Name + "\n" + params["body"].(string))
+		}
+		params["url"] = payload.URL
+	case "merge_request":
+		action, ok := gitlabApprovalActions[attrs.Action]
+		if !ok {
+			return nil, nil
+		}
+		params["title"] = fmt.Sprintf("[%s] MR !%d %s by %s", project, attrs.IID, action, payload.User.Username)
+		params["body"] = attrs.Title
+		params["url"] = attrs.URL
+	default:
+		return nil, nil
+	}
+	if params["body"] == "" {
+		params["body"] = project
+	}
+	return params, nil
+}
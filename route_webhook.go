@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/webhook"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+// Webhook URLs are stored as the device token
+const maxWebhookURLLength = 1024
+
+type WebhookInfo struct {
+	DeviceKey string `json:"device_key,omitempty"`
+	webhook.Target
+}
+
+func init() {
+	registerRoute("webhook", func(router fiber.Router) {
+		router.Post("/webhook/register", routeDoRegisterWebhook)
+	})
+}
+
+// routeDoRegisterWebhook registers a webhook target to a new or an existing device key
+func routeDoRegisterWebhook(c *fiber.Ctx) error {
+	if _, err := notifierFor(PlatformWebhook); err != nil {
+		return c.Status(501).JSON(failed(501, "webhook targets are disabled"))
+	}
+
+	var info WebhookInfo
+	if err := c.BodyParser(&info); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if info.URL == "" {
+		return c.Status(400).JSON(failed(400, "webhook url is empty"))
+	}
+	if len(info.URL) > maxWebhookURLLength {
+		return c.Status(400).JSON(failed(400, "webhook url is too long"))
+	}
+	if err := info.Target.Validate(); err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+
+	// Registering the same URL again keeps its secret unless a new one is given, a new
+	// URL gets a new secret, the generated secrets are only returned when they are created
+	created := false
+	if info.Secret == "" && info.DeviceKey != "" {
+		if old, err := db.DeviceByKey(info.DeviceKey); err == nil && old.Webhook != nil && old.Webhook.URL == info.URL {
+			info.Secret = old.Webhook.Secret
+		}
+	}
+	if info.Secret == "" {
+		secret, err := randomSecret()
+		if err != nil {
+			return c.Status(500).JSON(failed(500, "failed to generate webhook secret: %v", err))
+		}
+		info.Secret, created = secret, true
+	}
+
+	device := &database.Device{
+		Token:    info.URL,
+		Platform: PlatformWebhook,
+		Webhook: &database.WebhookTarget{
+			URL:          info.URL,
+			Method:       info.Method,
+			Headers:      info.Headers,
+			BodyTemplate: info.BodyTemplate,
+			Secret:       info.Secret,
+		},
+		RegisteredAt: time.Now().Unix(),
+	}
+	keepDeviceSettings(info.DeviceKey, device)
+	newKey, err := db.SaveDevice(info.DeviceKey, device)
+	if err != nil {
+		logger.Errorf("webhook registration failed: %v", err)
+		return c.Status(500).JSON(failed(500, "webhook registration failed: %v", err))
+	}
+
+	resp := map[string]string{
+		"key":        newKey,
+		"device_key": newKey,
+		"platform":   PlatformWebhook,
+	}
+	if created {
+		resp["secret"] = info.Secret
+	}
+	return c.JSON(data(resp))
+}
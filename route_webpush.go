@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/finb/bark-server/v2/database"
+	"github.com/finb/bark-server/v2/webpush"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mritd/logger"
+)
+
+// Subscription endpoints are URLs of the browser push service
+const maxWebPushEndpointLength = 1024
+
+type WebPushInfo struct {
+	DeviceKey string `json:"device_key,omitempty"`
+	// PushSubscription.toJSON() of the browser
+	Subscription webpush.Subscription `json:"subscription"`
+}
+
+func init() {
+	registerRoute("webpush", func(router fiber.Router) {
+		router.Get("/webpush/vapid-public-key", routeDoVAPIDPublicKey)
+		router.Post("/webpush/register", routeDoRegisterWebPush)
+	})
+}
+
+// routeDoVAPIDPublicKey returns the applicationServerKey the browsers subscribe with
+func routeDoVAPIDPublicKey(c *fiber.Ctx) error {
+	notifier, err := notifierFor(PlatformWeb)
+	if err != nil {
+		return c.Status(501).JSON(failed(501, "%s", err.Error()))
+	}
+	return c.JSON(data(map[string]string{
+		"public_key": notifier.(*webPushNotifier).client.PublicKey(),
+	}))
+}
+
+func routeDoRegisterWebPush(c *fiber.Ctx) error {
+	var info WebPushInfo
+	if err := c.BodyParser(&info); err != nil {
+		return c.Status(400).JSON(failed(400, "request bind failed: %v", err))
+	}
+	if info.Subscription.Endpoint == "" {
+		return c.Status(400).JSON(failed(400, "subscription endpoint is empty"))
+	}
+	if len(info.Subscription.Endpoint) > maxWebPushEndpointLength {
+		return c.Status(400).JSON(failed(400, "subscription endpoint is too long"))
+	}
+	if err := info.Subscription.Validate(); err != nil {
+		return c.Status(400).JSON(failed(400, "%s", err.Error()))
+	}
+
+	device := &database.Device{
+		Token:         info.Subscription.Endpoint,
+		Platform:      PlatformWeb,
+		WebPushP256dh: info.Subscription.Keys.P256dh,
+		WebPushAuth:   info.Subscription.Keys.Auth,
+		RegisteredAt:  time.Now().Unix(),
+	}
+	keepDeviceSettings(info.DeviceKey, device)
+	// if info.DeviceKey=="", newKey will be filled with a new uuid
+	newKey, err := db.SaveDevice(info.DeviceKey, device)
+	if err != nil {
+		logger.Errorf("web push registration failed: %v", err)
+		return c.Status(500).JSON(failed(500, "web push registration failed: %v", err))
+	}
+
+	return c.JSON(data(map[string]string{
+		"key":        newKey,
+		"device_key": newKey,
+		"platform":   PlatformWeb,
+	}))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// APNs throttles the background pushes of devices receiving more than a few per hour,
+// excess silent pushes are rejected before reaching APNs, -1 means no limit
+var maxSilentPushPerHour = 3
+
+const silentPushWindow = time.Hour
+
+// silentPushes records the recent silent pushes delivered to each device key
+var silentPushes = struct {
+	sync.Mutex
+	sent map[string][]time.Time
+}{sent: make(map[string][]time.Time)}
+
+// Set the maximum number of silent pushes of a device key per hour,
+// the recorded pushes are cleared
+func SetMaxSilentPushPerHour(count int) {
+	silentPushes.Lock()
+	defer silentPushes.Unlock()
+	maxSilentPushPerHour = count
+	silentPushes.sent = make(map[string][]time.Time)
+}
+
+// reserveSilentPush takes a silent push slot of the device key in one step, the returned
+// release gives the slot back when the push fails. When the device key is at the limit,
+// release is nil and wait is how long it has to wait for its next silent push
+func reserveSilentPush(deviceKey string, now time.Time) (release func(), wait time.Duration) {
+	silentPushes.Lock()
+	defer silentPushes.Unlock()
+	if maxSilentPushPerHour < 0 {
+		return func() {}, 0
+	}
+
+	sent := recentSilentPushes(silentPushes.sent[deviceKey], now)
+	if len(sent) >= maxSilentPushPerHour {
+		silentPushes.sent[deviceKey] = sent
+		if len(sent) == 0 {
+			return nil, silentPushWindow
+		}
+		return nil, sent[0].Add(silentPushWindow).Sub(now)
+	}
+	silentPushes.sent[deviceKey] = append(sent, now)
+
+	// Forget the device keys without recent pushes once in a while
+	if len(silentPushes.sent) > 1024 {
+		for key, times := range silentPushes.sent {
+			if len(recentSilentPushes(times, now)) == 0 {
+				delete(silentPushes.sent, key)
+			}
+		}
+	}
+	return func() { releaseSilentPush(deviceKey, now) }, 0
+}
+
+// releaseSilentPush gives back a slot taken at the given time,
+// the failed pushes don't count towards the limit
+func releaseSilentPush(deviceKey string, at time.Time) {
+	silentPushes.Lock()
+	defer silentPushes.Unlock()
+	sent := silentPushes.sent[deviceKey]
+	for i, t := range sent {
+		if t.Equal(at) {
+			silentPushes.sent[deviceKey] = append(sent[:i:i], sent[i+1:]...)
+			return
+		}
+	}
+}
+
+// recentSilentPushes drops the pushes older than the window
+func recentSilentPushes(sent []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(sent) && now.Sub(sent[i]) >= silentPushWindow {
+		i++
+	}
+	return sent[i:]
+}
@@ -0,0 +1,250 @@
+// Package webhook delivers push messages as signed HTTP requests to the webhook targets
+// registered instead of devices, such as chat rooms and automation servers.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/finb/bark-server/v2/netguard"
+)
+
+// Headers of the requests, the signature is the hex HMAC-SHA256 of "<timestamp>.<body>" keyed
+// with the secret of the target, so receivers can verify the request and reject replays
+const (
+	SignatureHeader = "X-Bark-Signature"
+	TimestampHeader = "X-Bark-Timestamp"
+	DeliveryHeader  = "X-Bark-Delivery"
+)
+
+// Methods of the webhook requests
+var methods = map[string]bool{
+	http.MethodPost:  true,
+	http.MethodPut:   true,
+	http.MethodPatch: true,
+}
+
+// Headers set by the client, the targets cannot override them
+var reservedHeaders = map[string]bool{
+	"Host":           true,
+	"Content-Length": true,
+	SignatureHeader:  true,
+	TimestampHeader:  true,
+	DeliveryHeader:   true,
+}
+
+// Functions of the body templates
+var templateFuncs = template.FuncMap{
+	// json encodes a value, so it can be embedded in a JSON body: {"text": {{json .Body}}}
+	"json": func(v interface{}) (string, error) {
+		bs, err := json.Marshal(v)
+		return string(bs), err
+	},
+}
+
+// Target is where the messages of a device key are delivered
+type Target struct {
+	URL string `json:"url"`
+	// POST (default), PUT or PATCH
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// text/template of the request body, the message is sent as JSON when empty
+	BodyTemplate string `json:"body_template,omitempty"`
+	// HMAC key of the request signature
+	Secret string `json:"secret,omitempty"`
+}
+
+// Validate checks the target and its body template
+func (t *Target) Validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid webhook url: %s", t.URL)
+	}
+	if t.Method != "" && !methods[strings.ToUpper(t.Method)] {
+		return fmt.Errorf("invalid webhook method: %s, must be POST, PUT or PATCH", t.Method)
+	}
+	for k := range t.Headers {
+		if reservedHeaders[http.CanonicalHeaderKey(k)] {
+			return fmt.Errorf("webhook header %s is set by the server", k)
+		}
+	}
+	if t.BodyTemplate != "" {
+		// Rendering a sample message catches the errors of the template fields as well
+		if _, _, err := t.Render(&Message{Params: map[string]interface{}{}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Message is the push message passed to the body template
+type Message struct {
+	ID        string
+	DeviceKey string
+	Title     string
+	Subtitle  string
+	Body      string
+	// Custom parameters of the push, such as url, group and level
+	Params    map[string]interface{}
+	Timestamp int64
+}
+
+// Render returns the request body of the message and its default content type
+func (t *Target) Render(msg *Message) ([]byte, string, error) {
+	if t.BodyTemplate == "" {
+		body := make(map[string]interface{}, len(msg.Params)+6)
+		for k, v := range msg.Params {
+			body[k] = v
+		}
+		body["id"] = msg.ID
+		body["device_key"] = msg.DeviceKey
+		body["title"] = msg.Title
+		body["subtitle"] = msg.Subtitle
+		body["body"] = msg.Body
+		body["timestamp"] = msg.Timestamp
+		bs, err := json.Marshal(body)
+		return bs, "application/json", err
+	}
+
+	tmpl, err := template.New("body").Funcs(templateFuncs).Option("missingkey=zero").Parse(t.BodyTemplate)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid webhook body template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return nil, "", fmt.Errorf("invalid webhook body template: %v", err)
+	}
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid(buf.Bytes()) {
+		contentType = "application/json"
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// Sign returns the signature header value of a request body
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RetryPolicy controls the retries of connection errors, 408, 429 and 5xx responses
+type RetryPolicy struct {
+	// Total attempts of a request including the first one, 1 disables retries
+	MaxAttempts int
+	// Delay before the first retry, doubled after every retry
+	Backoff time.Duration
+}
+
+// Result is the outcome of a delivery
+type Result struct {
+	// Status code of the last response, 0 when the target could not be reached
+	StatusCode int
+	Retries    int
+}
+
+// Client sends the webhook requests
+type Client struct {
+	httpClient *http.Client
+	policy     RetryPolicy
+	timeout    time.Duration
+}
+
+// NewClient creates a client giving up a delivery and its retries after the timeout,
+// a nil httpClient only connects to the targets on public addresses
+func NewClient(policy RetryPolicy, timeout time.Duration, httpClient *http.Client) (*Client, error) {
+	if policy.MaxAttempts < 1 {
+		return nil, fmt.Errorf("invalid number of webhook attempts: %d", policy.MaxAttempts)
+	}
+	if policy.Backoff < 0 {
+		return nil, fmt.Errorf("invalid webhook retry backoff")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid webhook timeout")
+	}
+	if httpClient == nil {
+		httpClient = netguard.NewHTTPClient(0)
+	}
+	return &Client{
+		httpClient: httpClient,
+		policy:     policy,
+		timeout:    timeout,
+	}, nil
+}
+
+// Send delivers the message to the target, retrying the transient failures until the timeout,
+// the pushes wait for the delivery so the timeout bounds the time they take
+func (c *Client) Send(t *Target, msg *Message) (*Result, error) {
+	body, contentType, err := t.Render(msg)
+	if err != nil {
+		return &Result{}, err
+	}
+	method := strings.ToUpper(t.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	result := &Result{}
+	delay := c.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		result.StatusCode, retryable, err = c.do(ctx, t, method, contentType, body, msg.ID)
+		// A retry starting at the deadline would fail anyway
+		if err == nil || !retryable || attempt >= c.policy.MaxAttempts || time.Now().Add(delay).After(deadline) {
+			return result, err
+		}
+		result.Retries++
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// do sends a single request, the signature is renewed with the timestamp of every attempt
+func (c *Client) do(ctx context.Context, t *Target, method, contentType string, body []byte, id string) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "bark-server")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(DeliveryHeader, id)
+	if t.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(t.Secret, timestamp, body))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retryable := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return resp.StatusCode, retryable, fmt.Errorf("webhook: %s", resp.Status)
+}
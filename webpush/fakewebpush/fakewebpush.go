@@ -0,0 +1,264 @@
+// Package fakewebpush implements a fake Web Push service, it creates browser subscriptions,
+// verifies the VAPID authorization, decrypts and records the received messages and can be
+// scripted to reject them, so the Web Push path can be tested offline.
+package fakewebpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/finb/bark-server/v2/fakescript"
+	"github.com/finb/bark-server/v2/webpush"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+const pushPathPrefix = "/push/"
+
+// AnyDevice scripts the responses of every subscription without its own script
+const AnyDevice = fakescript.AnyDevice
+
+// Message is a message received by the fake push service
+type Message struct {
+	// ID of the subscription, the last path segment of its endpoint
+	SubscriptionID string `json:"subscription_id"`
+	TTL            string `json:"ttl"`
+	Urgency        string `json:"urgency"`
+	Topic          string `json:"topic"`
+	// Subject of the VAPID token
+	Subject string          `json:"subject"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Server is a fake Web Push service
+type Server struct {
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+	messages      []Message
+	// status codes of the rejected messages
+	responses fakescript.Script[int]
+}
+
+// subscription holds the browser side keys of a subscription
+type subscription struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func New() *Server {
+	return &Server{
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// Subscribe creates a browser subscription with an endpoint on the server reachable at baseURL
+func (s *Server) Subscribe(baseURL string) (*webpush.Subscription, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		return nil, err
+	}
+	id := shortuuid.New()
+
+	s.mu.Lock()
+	s.subscriptions[id] = &subscription{key: key, auth: auth}
+	s.mu.Unlock()
+
+	return &webpush.Subscription{
+		Endpoint: strings.TrimSuffix(baseURL, "/") + pushPathPrefix + id,
+		Keys: webpush.Keys{
+			P256dh: base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(auth),
+		},
+	}, nil
+}
+
+// Script makes the following messages of the subscription, or AnyDevice, fail once each with the status codes
+func (s *Server) Script(id string, statusCodes ...int) {
+	s.responses.Queue(id, statusCodes...)
+}
+
+// Respond makes every message of the subscription, or AnyDevice, fail with the status code
+// once the scripted ones are used up
+func (s *Server) Respond(id string, statusCode int) {
+	s.responses.Fix(id, statusCode)
+}
+
+// Messages returns the messages received so far
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Reset clears the received messages and the scripted responses, the subscriptions are kept
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	s.responses.Reset()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, pushPathPrefix)
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, pushPathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	sub, ok := s.subscriptions[id]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "subscription not found", http.StatusGone)
+		return
+	}
+	subject, err := verifyVAPID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" {
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := decrypt(sub, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.messages = append(s.messages, Message{
+		SubscriptionID: id,
+		TTL:            r.Header.Get("TTL"),
+		Urgency:        r.Header.Get("Urgency"),
+		Topic:          r.Header.Get("Topic"),
+		Subject:        subject,
+		Payload:        payload,
+	})
+	s.mu.Unlock()
+
+	if code, scripted := s.responses.Next(id); scripted {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path+"/"+shortuuid.New())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyVAPID verifies the VAPID token against the public key sent with it, it returns the subject
+func verifyVAPID(r *http.Request) (string, error) {
+	var token, key string
+	for _, param := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "vapid "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch k {
+		case "t":
+			token = v
+		case "k":
+			key = v
+		}
+	}
+	keyBytes, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) != 65 {
+		return "", fmt.Errorf("invalid vapid public key")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), keyBytes)
+	if x == nil {
+		return "", fmt.Errorf("invalid vapid public key")
+	}
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return publicKey, nil
+	}); err != nil {
+		return "", fmt.Errorf("invalid vapid token: %v", err)
+	}
+	if !claims.VerifyAudience("http://"+r.Host, true) && !claims.VerifyAudience("https://"+r.Host, true) {
+		return "", fmt.Errorf("invalid vapid audience: %v", claims["aud"])
+	}
+	subject, _ := claims["sub"].(string)
+	return subject, nil
+}
+
+// decrypt decrypts an aes128gcm message with the browser keys of the subscription
+func decrypt(sub *subscription, body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, fmt.Errorf("message too short")
+	}
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	if len(body) < 21+idLen || len(body)-21-idLen > int(rs) {
+		return nil, fmt.Errorf("invalid content coding header")
+	}
+	asPublicBytes, ciphertext := body[21:21+idLen], body[21+idLen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender key")
+	}
+	sharedSecret, err := sub.key.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	// The keys are derived as of RFC 8291 section 3.4 and RFC 8188 section 2.2
+	keyInfo := append([]byte("WebPush: info\x00"), sub.key.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(sub.auth, sharedSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+	// Strip the padding and the last record delimiter
+	record = []byte(strings.TrimRight(string(record), "\x00"))
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		return nil, fmt.Errorf("invalid record delimiter")
+	}
+	return record[:len(record)-1], nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869) of a key shorter than a single block
+func hkdf(salt, secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
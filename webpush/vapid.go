@@ -0,0 +1,65 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// GenerateVAPIDKey generates a P-256 VAPID key
+func GenerateVAPIDKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// LoadOrCreateVAPIDKey reads the PEM encoded VAPID key, a new key is generated and written
+// to the path when it does not exist, so the browser subscriptions outlive restarts
+func LoadOrCreateVAPIDKey(path string) (*ecdsa.PrivateKey, bool, error) {
+	bs, err := os.ReadFile(path)
+	if err == nil {
+		key, err := jwt.ParseECPrivateKeyFromPEM(bs)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid vapid key %s: %v", path, err)
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, false, fmt.Errorf("invalid vapid key %s: must be a P-256 key", path)
+		}
+		return key, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, fmt.Errorf("failed to read vapid key: %v", err)
+	}
+
+	key, err := GenerateVAPIDKey()
+	if err != nil {
+		return nil, false, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, fmt.Errorf("failed to write vapid key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, false, fmt.Errorf("failed to write vapid key: %v", err)
+	}
+	return key, true, nil
+}
+
+// PublicKey returns the URL-safe base64 uncompressed public key, the applicationServerKey of the browsers
+func PublicKey(key *ecdsa.PrivateKey) (string, error) {
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", fmt.Errorf("invalid vapid key: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes()), nil
+}
@@ -0,0 +1,283 @@
+// Package webpush sends encrypted Web Push messages (RFC 8030, RFC 8291) to browser
+// push subscriptions, authenticated with the VAPID keys of the server (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/finb/bark-server/v2/netguard"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// Record size of the encrypted content, a message is a single record
+	recordSize = 4096
+	// salt(16) || rs(4) || idlen(1) || keyid(65)
+	headerSize = 16 + 4 + 1 + 65
+	// MaxPayload is the maximum size of a message before encryption,
+	// the record also holds the padding delimiter and the AEAD tag
+	MaxPayload = recordSize - headerSize - 1 - 16
+
+	// VAPID tokens are valid for at most 24 hours
+	vapidExpiration   = 12 * time.Hour
+	httpClientTimeout = 30 * time.Second
+)
+
+// Urgency of a message, push services may defer the less urgent ones to save battery
+const (
+	UrgencyVeryLow = "very-low"
+	UrgencyLow     = "low"
+	UrgencyNormal  = "normal"
+	UrgencyHigh    = "high"
+)
+
+// Topics replace the pending messages with the same topic, they use the URL-safe base64 alphabet
+var topicPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Subscription is a browser push subscription, as serialized by PushSubscription.toJSON()
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     Keys   `json:"keys"`
+}
+
+// Keys are the URL-safe base64 encoded keys of a subscription
+type Keys struct {
+	// P-256 public key of the browser, uncompressed point
+	P256dh string `json:"p256dh"`
+	// 16 bytes authentication secret
+	Auth string `json:"auth"`
+}
+
+// Validate checks the endpoint and the keys of the subscription
+func (s *Subscription) Validate() error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Host == "" || u.Scheme != "https" {
+		return fmt.Errorf("invalid subscription endpoint: %s", s.Endpoint)
+	}
+	if _, err := ecdh.P256().NewPublicKey(decodeKey(s.Keys.P256dh)); err != nil {
+		return fmt.Errorf("invalid subscription p256dh key")
+	}
+	if len(decodeKey(s.Keys.Auth)) != 16 {
+		return fmt.Errorf("invalid subscription auth secret")
+	}
+	return nil
+}
+
+// Options are the headers of a message
+type Options struct {
+	// Seconds the push service keeps the message for an offline browser, 0 delivers it now or never
+	TTL int
+	// One of the Urgency values, empty means normal
+	Urgency string
+	// Replaces a pending message with the same topic, omitted unless valid
+	Topic string
+}
+
+// Error is a rejected message
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webpush: %d %s", e.StatusCode, e.Message)
+}
+
+// Client sends messages with the VAPID key of the server
+type Client struct {
+	key        *ecdsa.PrivateKey
+	publicKey  string
+	subject    string
+	httpClient *http.Client
+}
+
+// NewClient creates a client identifying the server with the subject, a mailto: or https: URL,
+// a nil httpClient only connects to the push services on public addresses
+func NewClient(key *ecdsa.PrivateKey, subject string, httpClient *http.Client) (*Client, error) {
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, fmt.Errorf("invalid vapid subject: %s, must be a mailto: or https: URL", subject)
+	}
+	publicKey, err := PublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = netguard.NewHTTPClient(httpClientTimeout)
+	}
+	return &Client{
+		key:        key,
+		publicKey:  publicKey,
+		subject:    subject,
+		httpClient: httpClient,
+	}, nil
+}
+
+// PublicKey returns the application server key the browsers subscribe with
+func (c *Client) PublicKey() string {
+	return c.publicKey
+}
+
+// Send encrypts the payload to the subscription and delivers it to its push service
+func (c *Client) Send(sub *Subscription, payload []byte, opts Options) error {
+	body, err := Encrypt(sub, payload)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	token, err := c.vapidToken(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, c.publicKey))
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(opts.TTL))
+	if opts.Urgency != "" {
+		req.Header.Set("Urgency", opts.Urgency)
+	}
+	if topicPattern.MatchString(opts.Topic) {
+		req.Header.Set("Topic", opts.Topic)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
+
+// vapidToken signs the VAPID token of the push service origin
+func (c *Client) vapidToken(audience string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": audience,
+		"exp": time.Now().Add(vapidExpiration).Unix(),
+		"sub": c.subject,
+	})
+	return token.SignedString(c.key)
+}
+
+// Encrypt encrypts the payload to the keys of the subscription with the
+// aes128gcm content encoding, the encryption keys are derived as of RFC 8291
+func Encrypt(sub *Subscription, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayload {
+		return nil, fmt.Errorf("payload too large: %d bytes, the maximum is %d bytes", len(payload), MaxPayload)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(decodeKey(sub.Keys.P256dh))
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription p256dh key")
+	}
+	authSecret := decodeKey(sub.Keys.Auth)
+	if len(authSecret) != 16 {
+		return nil, fmt.Errorf("invalid subscription auth secret")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encrypt(uaPublic, authSecret, asPrivate, salt, payload)
+}
+
+// encrypt encrypts the payload with the ephemeral key and the salt of the message
+func encrypt(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt, payload []byte) ([]byte, error) {
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	aead, nonce, err := contentCipher(sharedSecret, authSecret, salt, uaPublic.Bytes(), asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// The single record is the last one, delimited by 0x02 without padding
+	record := append(append([]byte{}, payload...), 0x02)
+	return aead.Seal(header, nonce, record, nil), nil
+}
+
+// contentCipher derives the content encryption key and nonce of a message from the
+// ECDH shared secret, the browser auth secret and public key, and the server public key
+func contentCipher(sharedSecret, authSecret, salt, uaPublic, asPublic []byte) (cipher.AEAD, []byte, error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, sharedSecret), keyInfo, 32)
+
+	prk := hkdfExtract(salt, ikm)
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand expands a single block, all the derived keys are shorter than SHA-256
+func hkdfExpand(prk, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}
+
+// decodeKey decodes URL-safe base64 with or without padding, as sent by browsers
+func decodeKey(s string) []byte {
+	s = strings.TrimRight(s, "=")
+	if bs, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return bs
+	}
+	bs, _ := base64.RawStdEncoding.DecodeString(s)
+	return bs
+}
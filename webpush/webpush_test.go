@@ -0,0 +1,58 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"testing"
+)
+
+// TestEncryptVector encrypts the example of RFC 8291 Appendix A with its ephemeral key and salt
+func TestEncryptVector(t *testing.T) {
+	decode := func(s string) []byte {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asPrivate, err := ecdh.P256().NewPrivateKey(decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(asPrivate.PublicKey().Bytes(), decode("BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8")) {
+		t.Fatal("unexpected application server public key")
+	}
+
+	body, err := encrypt(uaPublic, decode("BTBZMqHH6r4Tts7J_aSIgg"), asPrivate, decode("DGv6ra1nlYgDCS1FRnbzlw"),
+		[]byte("When I grow up, I want to be a watermelon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Fatalf("unexpected message:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	keys := Keys{
+		P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	for endpoint, valid := range map[string]bool{
+		"https://fcm.googleapis.com/fcm/send/abc": true,
+		"http://fcm.googleapis.com/fcm/send/abc":  false,
+		"ftp://fcm.googleapis.com/fcm/send/abc":   false,
+		"https:///send/abc":                       false,
+	} {
+		sub := &Subscription{Endpoint: endpoint, Keys: keys}
+		if err := sub.Validate(); (err == nil) != valid {
+			t.Errorf("%s: unexpected validation result: %v", endpoint, err)
+		}
+	}
+}